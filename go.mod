@@ -2,10 +2,14 @@ module github.com/singleservingfriend/klo
 
 go 1.21
 
-require github.com/urfave/cli/v2 v2.25.7
+require (
+	github.com/urfave/cli/v2 v2.25.7
+	golang.org/x/term v0.29.0
+)
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
+	golang.org/x/sys v0.30.0 // indirect
 )
@@ -0,0 +1,588 @@
+package interp
+
+import (
+	"fmt"
+	"go/constant"
+	"go/token"
+	"math"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/singleservingfriend/klo/parser"
+	"github.com/singleservingfriend/klo/transpiler"
+)
+
+func (in *Interpreter) eval(expr parser.Expression) any {
+	switch e := expr.(type) {
+	case *parser.Identifier:
+		if !in.defined(e.Value) {
+			in.fail(e, "name '%s' is not defined", e.Value)
+		}
+		return in.get(e.Value)
+	case *parser.StringLiteral:
+		return e.Value
+	case *parser.InterpolatedString:
+		return in.format(e.Parts)
+	case *parser.NumberLiteral:
+		if e.IsFloat {
+			return e.Float
+		}
+		return int(e.Int)
+	case *parser.BooleanLiteral:
+		return e.Value
+	case *parser.NoneLiteral:
+		return nil
+	case *parser.UnaryExpression:
+		if value, ok := in.constant(e); ok {
+			return value
+		}
+		return in.evalUnary(e)
+	case *parser.BinaryExpression:
+		if value, ok := in.constant(e); ok {
+			return value
+		}
+		return in.evalBinary(e)
+	case *parser.RangeExpression:
+		return in.evalRange(e)
+	case *parser.CallExpression:
+		return in.evalCall(e)
+	case *parser.ListLiteral:
+		return in.evalList(e, in.info.TypeOf(e))
+	case *parser.DictLiteral:
+		return in.evalDict(e, in.info.TypeOf(e))
+	case *parser.IndexExpression:
+		return in.evalIndex(e)
+	case *parser.MemberExpression:
+		in.fail(e, "%s must be called", e)
+	default:
+		in.fail(expr, "unsupported expression %s", expr)
+	}
+	return nil
+}
+
+// evalValue evaluates an expression that is stored in a location of type
+// target, converting ints to floats and giving list and dict literals
+// the element types of their destination, as the generated Go does
+func (in *Interpreter) evalValue(expr parser.Expression, target *transpiler.Type) any {
+	if target != nil {
+		switch e := expr.(type) {
+		case *parser.ListLiteral:
+			if target.Kind == transpiler.List {
+				return in.evalList(e, target)
+			}
+		case *parser.DictLiteral:
+			if target.Kind == transpiler.Map {
+				return in.evalDict(e, target)
+			}
+		}
+	}
+	return convert(in.eval(expr), target)
+}
+
+func (in *Interpreter) evalList(list *parser.ListLiteral, listType *transpiler.Type) any {
+	elements := make([]any, len(list.Elements))
+	for i, element := range list.Elements {
+		elements[i] = in.evalValue(element, listType.Elem)
+	}
+	return elements
+}
+
+func (in *Interpreter) evalDict(dict *parser.DictLiteral, mapType *transpiler.Type) any {
+	m := make(map[any]any, len(dict.Entries))
+	for _, entry := range dict.Entries {
+		key := in.evalValue(entry.Key, mapType.Key)
+		m[key] = in.evalValue(entry.Value, mapType.Elem)
+	}
+	return m
+}
+
+// evalRange builds the list of ints of a range used outside a for loop
+func (in *Interpreter) evalRange(r *parser.RangeExpression) any {
+	start, step := 0, 1
+	if r.Start != nil {
+		start = in.intValue(r.Start)
+	}
+	stop := in.intValue(r.Stop)
+	if r.Step != nil {
+		step = in.intValue(r.Step)
+	}
+	if step == 0 {
+		in.fail(r, "range() step must not be zero")
+	}
+
+	values := []any{}
+	for i := start; step > 0 && i < stop || step < 0 && i > stop; i += step {
+		values = append(values, i)
+	}
+	return values
+}
+
+// intValue evaluates an expression that has to be an int
+func (in *Interpreter) intValue(expr parser.Expression) int {
+	value := in.eval(expr)
+	n, ok := value.(int)
+	if !ok {
+		in.fail(expr, "expected an int, got %s", typeName(value))
+	}
+	return n
+}
+
+// intIndex returns the value of an index into a list or string
+func (in *Interpreter) intIndex(expr parser.Expression, index any) int {
+	i, ok := index.(int)
+	if !ok {
+		in.fail(expr, "indices must be int, not %s", typeName(index))
+	}
+	return i
+}
+
+func (in *Interpreter) evalIndex(expr *parser.IndexExpression) any {
+	object := in.eval(expr.Object)
+	index := in.evalValue(expr.Index, in.info.TypeOf(expr.Object).Key)
+
+	in.at(expr)
+	switch o := object.(type) {
+	case []any:
+		return o[in.intIndex(expr.Index, index)]
+	case string:
+		// Indexing a string yields a one-character string, not a byte
+		return string([]rune(o)[in.intIndex(expr.Index, index)])
+	case map[any]any:
+		value, ok := o[index]
+		if !ok {
+			in.fail(expr, "KeyError: %v", index)
+		}
+		return value
+	}
+	in.fail(expr, "%s is not subscriptable", typeName(object))
+	return nil
+}
+
+func (in *Interpreter) evalCall(call *parser.CallExpression) any {
+	name, ok := call.Function.(*parser.Identifier)
+	if !ok {
+		in.fail(call.Function, "%s is not callable", call.Function)
+	}
+
+	if def, ok := in.functions[name.Value]; ok {
+		return in.callFunction(def, call)
+	}
+	if fn, ok := in.builtins[name.Value]; ok {
+		return in.callBuiltin(name.Value, fn, call)
+	}
+	if name.Value == "len" && len(call.Arguments) == 1 {
+		return in.length(call.Arguments[0])
+	}
+	in.fail(name, "name '%s' is not defined", name.Value)
+	return nil
+}
+
+// callBuiltin calls a function defined in Go
+func (in *Interpreter) callBuiltin(name string, fn Builtin, call *parser.CallExpression) any {
+	args := make([]any, len(call.Arguments))
+	for i, arg := range call.Arguments {
+		args[i] = in.eval(arg)
+	}
+
+	in.at(call)
+	result, err := callGo(fn, args)
+	if err != nil {
+		in.fail(call, "%s(): %v", name, err)
+	}
+	return result
+}
+
+// callGo calls a Builtin, turning a panic into a hostPanic so that it is
+// not taken for a runtime error of the program
+func callGo(fn Builtin, args []any) (any, error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panic(hostPanic{value: r, stack: debug.Stack()})
+		}
+	}()
+	return fn(args)
+}
+
+// callFunction calls a def. Arguments are converted to the parameter
+// types, and the result to the result type, as in the generated Go
+// function.
+func (in *Interpreter) callFunction(def *parser.FunctionDefinition, call *parser.CallExpression) any {
+	params, result, _ := in.info.Function(def.Name)
+	if len(call.Arguments) != len(def.Parameters) {
+		in.fail(call, "%s() takes %d arguments, got %d", def.Name, len(def.Parameters), len(call.Arguments))
+	}
+
+	locals := make(map[string]any, len(def.Parameters))
+	for i, arg := range call.Arguments {
+		var param *transpiler.Type
+		if i < len(params) {
+			param = params[i]
+		}
+		locals[def.Parameters[i]] = in.evalValue(arg, param)
+	}
+
+	in.at(call)
+	if in.depth >= maxCallDepth {
+		in.fail(call, "maximum recursion depth exceeded")
+	}
+	f := &frame{function: def.Name, locals: locals, call: call, caller: in.frame}
+	in.frame = f
+	in.depth++
+	c := in.execBlock(def.Body)
+	in.frame = f.caller
+	in.depth--
+
+	switch {
+	case c == returnValue:
+		return f.result
+	case result != nil:
+		// Falling off the end returns the zero value
+		return zeroValue(result)
+	default:
+		return nil
+	}
+}
+
+// length counts characters rather than bytes for strings
+func (in *Interpreter) length(arg parser.Expression) any {
+	switch v := in.eval(arg).(type) {
+	case string:
+		return utf8.RuneCountInString(v)
+	case []any:
+		return len(v)
+	case map[any]any:
+		return len(v)
+	default:
+		in.fail(arg, "object of type %s has no len()", typeName(v))
+		return nil
+	}
+}
+
+// condition evaluates an expression used as a truth value
+func (in *Interpreter) condition(expr parser.Expression) bool {
+	return truthy(in.eval(expr))
+}
+
+func (in *Interpreter) evalUnary(expr *parser.UnaryExpression) any {
+	if expr.Operator == "not" {
+		return !in.condition(expr.Operand)
+	}
+
+	operand := in.eval(expr.Operand)
+	switch v := operand.(type) {
+	case int:
+		if expr.Operator == "-" {
+			return -v
+		}
+		return v
+	case float64:
+		if expr.Operator == "-" {
+			return -v
+		}
+		return v
+	}
+	in.fail(expr, "bad operand type for unary %s: %s", expr.Operator, typeName(operand))
+	return nil
+}
+
+func (in *Interpreter) evalBinary(expr *parser.BinaryExpression) any {
+	switch expr.Operator {
+	case "and":
+		return in.condition(expr.Left) && in.condition(expr.Right)
+	case "or":
+		return in.condition(expr.Left) || in.condition(expr.Right)
+	case "in":
+		return in.contains(expr)
+	case "not in":
+		return !in.contains(expr)
+	case "+":
+		if in.info.TypeOf(expr).Kind == transpiler.String {
+			return in.concatenate(expr)
+		}
+	}
+
+	leftType, rightType := in.info.TypeOf(expr.Left), in.info.TypeOf(expr.Right)
+
+	// Mixed int and float operands are computed as floats
+	var operandType *transpiler.Type
+	if isNumeric(leftType) && isNumeric(rightType) {
+		operandType = leftType
+		if rightType.Kind == transpiler.Float {
+			operandType = rightType
+		}
+	}
+	left := in.evalValue(expr.Left, operandType)
+	right := in.evalValue(expr.Right, operandType)
+
+	in.at(expr)
+	switch {
+	case expr.Operator == "*" && (leftType.Kind == transpiler.String || rightType.Kind == transpiler.String):
+		// Repetition, as in "-" * 10
+		if s, ok := left.(string); ok {
+			return strings.Repeat(s, in.intIndex(expr.Right, right))
+		}
+		return strings.Repeat(right.(string), in.intIndex(expr.Left, left))
+	case (expr.Operator == "==" || expr.Operator == "!=") && (isCollection(leftType) || isCollection(rightType)):
+		// Lists and dicts are compared element by element
+		return reflect.DeepEqual(left, right) == (expr.Operator == "==")
+	}
+
+	result, ok := operate(expr.Operator, left, right)
+	if !ok {
+		in.fail(expr, "unsupported operand types for %s: %s and %s", expr.Operator, typeName(left), typeName(right))
+	}
+	return result
+}
+
+// operate applies an arithmetic or comparison operator. Operands whose
+// types the type checker did not know may still be an int and a float,
+// which are computed as floats.
+func operate(operator string, left, right any) (any, bool) {
+	switch l := left.(type) {
+	case int:
+		switch r := right.(type) {
+		case int:
+			return operateInts(operator, l, r)
+		case float64:
+			return operateFloats(operator, float64(l), r)
+		}
+	case float64:
+		switch r := right.(type) {
+		case int:
+			return operateFloats(operator, l, float64(r))
+		case float64:
+			return operateFloats(operator, l, r)
+		}
+	case string:
+		if r, ok := right.(string); ok {
+			if operator == "+" {
+				return l + r, true
+			}
+			return compare(operator, l, r)
+		}
+	}
+
+	switch operator {
+	case "==":
+		return left == right, true
+	case "!=":
+		return left != right, true
+	}
+	return nil, false
+}
+
+func operateInts(operator string, l, r int) (any, bool) {
+	switch operator {
+	case "+":
+		return l + r, true
+	case "-":
+		return l - r, true
+	case "*":
+		return l * r, true
+	case "/":
+		return l / r, true
+	case "%":
+		return l % r, true
+	}
+	return compare(operator, l, r)
+}
+
+func operateFloats(operator string, l, r float64) (any, bool) {
+	switch operator {
+	case "+":
+		return l + r, true
+	case "-":
+		return l - r, true
+	case "*":
+		return l * r, true
+	case "/":
+		return l / r, true
+	case "%":
+		return math.Mod(l, r), true
+	}
+	return compare(operator, l, r)
+}
+
+func compare[T int | float64 | string](operator string, l, r T) (any, bool) {
+	switch operator {
+	case "==":
+		return l == r, true
+	case "!=":
+		return l != r, true
+	case "<":
+		return l < r, true
+	case "<=":
+		return l <= r, true
+	case ">":
+		return l > r, true
+	case ">=":
+		return l >= r, true
+	}
+	return nil, false
+}
+
+// contains evaluates "x in container" for dicts, lists and strings
+func (in *Interpreter) contains(expr *parser.BinaryExpression) bool {
+	container := in.eval(expr.Right)
+	containerType := in.info.TypeOf(expr.Right)
+
+	switch c := container.(type) {
+	case map[any]any:
+		_, ok := c[in.evalValue(expr.Left, containerType.Key)]
+		return ok
+	case string:
+		element := in.eval(expr.Left)
+		s, ok := element.(string)
+		if !ok {
+			in.fail(expr, "'in <str>' requires str as left operand, not %s", typeName(element))
+		}
+		return strings.Contains(c, s)
+	case []any:
+		element := in.evalValue(expr.Left, containerType.Elem)
+		in.at(expr)
+		return slices.Contains(c, element)
+	}
+	in.fail(expr.Right, "argument of type %s is not iterable", typeName(container))
+	return false
+}
+
+// concatenate evaluates a chain of string concatenations. Operands that
+// are not strings are formatted the way print formats them.
+func (in *Interpreter) concatenate(expr *parser.BinaryExpression) any {
+	parts := in.concatenationParts(expr)
+	var out strings.Builder
+	for _, part := range parts {
+		switch {
+		case part.Value == nil:
+			out.WriteString(part.Text)
+		case in.info.TypeOf(part.Value).Kind == transpiler.String:
+			s, _ := in.eval(part.Value).(string)
+			out.WriteString(s)
+		default:
+			return in.format(parts)
+		}
+	}
+	return out.String()
+}
+
+// concatenationParts flattens a chain of concatenations, such as
+// "Total: " + n + " items", into the pieces of the resulting string
+func (in *Interpreter) concatenationParts(expr parser.Expression) []parser.InterpolationPart {
+	switch e := expr.(type) {
+	case *parser.BinaryExpression:
+		if e.Operator == "+" && in.info.TypeOf(e).Kind == transpiler.String {
+			return append(in.concatenationParts(e.Left), in.concatenationParts(e.Right)...)
+		}
+	case *parser.StringLiteral:
+		return []parser.InterpolationPart{{Text: e.Value}}
+	}
+	return []parser.InterpolationPart{{Value: expr}}
+}
+
+// format builds the string made of the parts of an f-string, with the
+// fmt verbs the generated fmt.Sprintf would use
+func (in *Interpreter) format(parts []parser.InterpolationPart) any {
+	var text, format strings.Builder
+	var args []any
+	for _, part := range parts {
+		if part.Value == nil {
+			text.WriteString(part.Text)
+			format.WriteString(strings.ReplaceAll(part.Text, "%", "%%"))
+			continue
+		}
+
+		// The type checker has rejected invalid specs
+		verb, toFloat, percent, _ := transpiler.FormatVerb(part.Spec, in.info.TypeOf(part.Value))
+		value := in.eval(part.Value)
+		if toFloat || percent {
+			value = convert(value, &transpiler.Type{Kind: transpiler.Float})
+		}
+		if f, ok := value.(float64); ok && percent {
+			value = f * 100
+		}
+		format.WriteString(verb)
+		args = append(args, value)
+	}
+
+	if len(args) == 0 {
+		return text.String()
+	}
+	return fmt.Sprintf(format.String(), args...)
+}
+
+// constant evaluates arithmetic on number literals, such as 0.1 + 0.2,
+// the way the Go compiler evaluates the constant expression it is
+// transpiled to: exactly, rounding only the result. The second result is
+// false for any other expression.
+func (in *Interpreter) constant(expr parser.Expression) (any, bool) {
+	c, ok := constantValue(expr)
+	if !ok {
+		return nil, false
+	}
+	if c.Kind() == constant.Int {
+		n, exact := constant.Int64Val(c)
+		if !exact || int64(int(n)) != n {
+			in.fail(expr, "constant %s overflows int", c)
+		}
+		return int(n), true
+	}
+	f, _ := constant.Float64Val(c)
+	return f, true
+}
+
+func constantValue(expr parser.Expression) (constant.Value, bool) {
+	switch e := expr.(type) {
+	case *parser.NumberLiteral:
+		kind := token.INT
+		if e.IsFloat {
+			kind = token.FLOAT
+		}
+		c := constant.MakeFromLiteral(e.Value, kind, 0)
+		return c, c.Kind() != constant.Unknown
+	case *parser.UnaryExpression:
+		operand, ok := constantValue(e.Operand)
+		if !ok || e.Operator == "not" {
+			return nil, false
+		}
+		return constant.UnaryOp(constantOperators[e.Operator], operand, 0), true
+	case *parser.BinaryExpression:
+		op, ok := constantOperators[e.Operator]
+		if !ok {
+			return nil, false
+		}
+		left, ok := constantValue(e.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := constantValue(e.Right)
+		if !ok {
+			return nil, false
+		}
+
+		integers := left.Kind() == constant.Int && right.Kind() == constant.Int
+		switch {
+		case (op == token.QUO || op == token.REM) && constant.Sign(right) == 0:
+			// Left to fail at run time
+			return nil, false
+		case op == token.REM && !integers:
+			// Float remainders are computed by math.Mod
+			return nil, false
+		case op == token.QUO && integers:
+			op = token.QUO_ASSIGN
+		}
+		return constant.BinaryOp(left, op, right), true
+	}
+	return nil, false
+}
+
+// constantOperators maps the klo operators of constant expressions to Go
+var constantOperators = map[string]token.Token{
+	"+": token.ADD,
+	"-": token.SUB,
+	"*": token.MUL,
+	"/": token.QUO,
+	"%": token.REM,
+}
@@ -0,0 +1,490 @@
+// Package interp runs klo programs by walking their syntax tree, so that
+// they run without a Go toolchain. Programs are type checked by the
+// transpiler first, and values get the Go types the transpiled program
+// would give them, so both backends print the same output.
+package interp
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/singleservingfriend/klo/parser"
+	"github.com/singleservingfriend/klo/transpiler"
+)
+
+// maxCallDepth bounds the nesting of function calls, so that runaway
+// recursion is reported instead of exhausting the Go stack
+const maxCallDepth = 10000
+
+// Interpreter runs klo programs. Values are int, float64, string, bool
+// and nil, lists are []any and dicts are map[any]any, so that print
+// formats them the way fmt.Println does in the generated Go code.
+type Interpreter struct {
+	out       io.Writer
+	info      *transpiler.Info
+	globals   map[string]any
+	functions map[string]*parser.FunctionDefinition
+	builtins  map[string]Builtin
+	frame     *frame      // innermost function call, nil in the main program
+	depth     int         // number of active function calls
+	span      parser.Span // code being run, where runtime errors are reported
+}
+
+// frame holds the variables of a function call
+type frame struct {
+	function string
+	locals   map[string]any
+	call     *parser.CallExpression
+	caller   *frame
+	result   any // value of the return statement that ended the call
+}
+
+// Builtin is a function written in Go that programs can call. It is given
+// the values of the arguments and returns the value of the call, which is
+// nil for a function without a result. An error stops the program with a
+// runtime error at the call. A panic is not a runtime error of the
+// program: Run panics in turn, with an error holding the stack of the
+// function.
+type Builtin func(args []any) (any, error)
+
+// control tells the statements around a statement how to go on after it
+type control int
+
+const (
+	proceed control = iota
+	breakLoop
+	continueLoop
+	returnValue
+)
+
+// New returns an interpreter that writes the output of print to out
+func New(out io.Writer) *Interpreter {
+	return &Interpreter{
+		out:       out,
+		globals:   map[string]any{},
+		functions: map[string]*parser.FunctionDefinition{},
+		builtins:  map[string]Builtin{},
+	}
+}
+
+// Define makes a Go function callable by programs under name. A def of
+// the same name takes precedence.
+func (in *Interpreter) Define(name string, fn Builtin) {
+	in.builtins[name] = fn
+}
+
+// Global returns the value of a variable of the main program. The second
+// result is false when no program run so far has assigned it.
+func (in *Interpreter) Global(name string) (any, bool) {
+	value, ok := in.globals[name]
+	return value, ok
+}
+
+// SetGlobal assigns a variable of the main program
+func (in *Interpreter) SetGlobal(name string, value any) {
+	in.globals[name] = value
+}
+
+// Globals returns the names of the variables of the main program
+func (in *Interpreter) Globals() []string {
+	names := make([]string, 0, len(in.globals))
+	for name := range in.globals {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Run runs a program that has been type checked with transpiler.Check.
+// Functions can be called before their definition, as in Go. Variables
+// and functions stay defined after Run returns, so that the next program
+// run can use them. Runtime errors, such as a missing key or an index out
+// of range, are reported as parser.Diagnostics.
+func (in *Interpreter) Run(program *parser.Program, info *transpiler.Info) error {
+	return in.RunFrom(program, info, 0)
+}
+
+// RunFrom is Run for the statements of a program from index start on, such
+// as those added to it since it was last run. The functions of the whole
+// program can be called.
+func (in *Interpreter) RunFrom(program *parser.Program, info *transpiler.Info, start int) (err error) {
+	in.info = info
+	in.frame, in.depth = nil, 0
+
+	for _, stmt := range program.Statements {
+		if def, ok := stmt.(*parser.FunctionDefinition); ok {
+			in.functions[def.Name] = def
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = in.runtimeError(r)
+		}
+	}()
+	in.execBlock(program.Statements[start:])
+	return nil
+}
+
+// failure is a runtime error raised by the interpreter itself. It unwinds
+// the Go stack as a panic, which Run recovers from.
+type failure struct {
+	diagnostic parser.Diagnostic
+}
+
+// hostPanic is a panic of a Builtin, which Run passes on
+type hostPanic struct {
+	value any
+	stack []byte // stack of the Builtin when it panicked
+}
+
+func (p hostPanic) Error() string {
+	return fmt.Sprintf("panic in a Go function called by a klo program: %v\n\n%s", p.value, p.stack)
+}
+
+// Unwrap returns the value of the panic when it is an error
+func (p hostPanic) Unwrap() error {
+	err, _ := p.value.(error)
+	return err
+}
+
+// fail stops the program with a runtime error about node
+func (in *Interpreter) fail(node interface {
+	Pos() parser.Position
+	End() parser.Position
+}, format string, args ...any) {
+	panic(failure{parser.Errorf(parser.SpanOf(node), parser.CodeRuntime, format, args...)})
+}
+
+// runtimeError turns a recovered panic into a diagnostic, noting the
+// function calls that led to it. Panics of Go operations, such as an
+// index out of range, are reported at the code being run.
+func (in *Interpreter) runtimeError(r any) error {
+	var diagnostic parser.Diagnostic
+	switch e := r.(type) {
+	case failure:
+		diagnostic = e.diagnostic
+	case hostPanic:
+		in.frame, in.depth = nil, 0
+		panic(e)
+	case runtime.Error:
+		message := strings.TrimPrefix(e.Error(), "runtime error: ")
+		diagnostic = parser.Errorf(in.span, parser.CodeRuntime, "%s", message)
+	case error:
+		diagnostic = parser.Errorf(in.span, parser.CodeRuntime, "%s", e)
+	case string:
+		diagnostic = parser.Errorf(in.span, parser.CodeRuntime, "%s", e)
+	default:
+		panic(r)
+	}
+
+	for f := in.frame; f != nil; f = f.caller {
+		diagnostic = diagnostic.WithNote("in %s(), called at line %d", f.function, f.call.Pos().Line)
+	}
+	in.frame, in.depth = nil, 0
+	return parser.Diagnostics{diagnostic}
+}
+
+// at records the code being run, for runtime errors raised by Go
+// operations
+func (in *Interpreter) at(node interface {
+	Pos() parser.Position
+	End() parser.Position
+}) {
+	in.span = parser.SpanOf(node)
+}
+
+func (in *Interpreter) execBlock(stmts []parser.Statement) control {
+	for _, stmt := range stmts {
+		if c := in.exec(stmt); c != proceed {
+			return c
+		}
+	}
+	return proceed
+}
+
+func (in *Interpreter) exec(stmt parser.Statement) control {
+	in.at(stmt)
+
+	switch s := stmt.(type) {
+	case *parser.PrintStatement:
+		args := make([]any, len(s.Arguments))
+		for i, arg := range s.Arguments {
+			args[i] = in.eval(arg)
+		}
+		fmt.Fprintln(in.out, args...)
+	case *parser.AssignmentStatement:
+		target, _ := in.variableType(s.Name)
+		in.set(s.Name, in.evalValue(s.Value, target))
+	case *parser.IndexAssignmentStatement:
+		in.execIndexAssignment(s)
+	case *parser.DeleteStatement:
+		in.execDelete(s)
+	case *parser.IfStatement:
+		for _, branch := range s.Branches {
+			if in.condition(branch.Condition) {
+				return in.execBlock(branch.Body)
+			}
+		}
+		return in.execBlock(s.Else)
+	case *parser.WhileStatement:
+		for in.condition(s.Condition) {
+			if done, c := in.loopBody(s.Body); done {
+				return c
+			}
+		}
+	case *parser.ForStatement:
+		return in.execFor(s)
+	case *parser.BreakStatement:
+		return breakLoop
+	case *parser.ContinueStatement:
+		return continueLoop
+	case *parser.ReturnStatement:
+		in.execReturn(s)
+		return returnValue
+	case *parser.ExpressionStatement:
+		in.execExpressionStatement(s)
+	case *parser.FunctionDefinition:
+		// Defined by Run before the program starts
+	default:
+		in.fail(stmt, "unsupported statement %T", stmt)
+	}
+	return proceed
+}
+
+// loopBody runs one iteration of a loop. It reports whether the loop
+// ends, and with what control for the statements around it.
+func (in *Interpreter) loopBody(body []parser.Statement) (done bool, c control) {
+	switch c := in.execBlock(body); c {
+	case breakLoop:
+		return true, proceed
+	case returnValue:
+		return true, c
+	}
+	return false, proceed
+}
+
+func (in *Interpreter) execReturn(stmt *parser.ReturnStatement) {
+	var result *transpiler.Type
+	if in.frame != nil {
+		_, result, _ = in.info.Function(in.frame.function)
+	}
+
+	var value any
+	switch {
+	case stmt.Value != nil:
+		value = in.evalValue(stmt.Value, result)
+	case result != nil:
+		value = zeroValue(result)
+	}
+	if in.frame != nil {
+		in.frame.result = value
+	}
+}
+
+func (in *Interpreter) execIndexAssignment(stmt *parser.IndexAssignmentStatement) {
+	object := in.eval(stmt.Target.Object)
+	index := in.evalValue(stmt.Target.Index, in.info.TypeOf(stmt.Target.Object).Key)
+	value := in.evalValue(stmt.Value, in.info.TypeOf(stmt.Target))
+	in.setElement(stmt.Target, object, index, value)
+}
+
+// setElement stores value at index of object, the value of target.Object
+func (in *Interpreter) setElement(target *parser.IndexExpression, object, index, value any) {
+	in.at(target)
+	switch o := object.(type) {
+	case []any:
+		o[in.intIndex(target.Index, index)] = value
+	case map[any]any:
+		o[index] = value
+	default:
+		in.fail(target, "%s does not support item assignment", typeName(object))
+	}
+}
+
+func (in *Interpreter) execDelete(stmt *parser.DeleteStatement) {
+	object := in.eval(stmt.Target.Object)
+	index := in.evalValue(stmt.Target.Index, in.info.TypeOf(stmt.Target.Object).Key)
+
+	in.at(stmt.Target)
+	switch o := object.(type) {
+	case []any:
+		i := in.intIndex(stmt.Target.Index, index)
+		in.store(stmt.Target.Object, slices.Delete(o, i, i+1))
+	case map[any]any:
+		delete(o, index)
+	default:
+		in.fail(stmt.Target, "cannot delete elements of %s", typeName(object))
+	}
+}
+
+func (in *Interpreter) execExpressionStatement(stmt *parser.ExpressionStatement) {
+	// xs.append(v) grows the list in place
+	if call, ok := stmt.Expression.(*parser.CallExpression); ok {
+		if member, ok := call.Function.(*parser.MemberExpression); ok && member.Name == "append" {
+			list, ok := in.eval(member.Object).([]any)
+			if !ok || len(call.Arguments) != 1 {
+				in.fail(member, "%s has no method append", typeName(list))
+			}
+			elem := in.info.TypeOf(member.Object).Elem
+			in.store(member.Object, append(list, in.evalValue(call.Arguments[0], elem)))
+			return
+		}
+	}
+	in.eval(stmt.Expression)
+}
+
+// store assigns a value to a variable or element named by an expression
+func (in *Interpreter) store(target parser.Expression, value any) {
+	switch t := target.(type) {
+	case *parser.Identifier:
+		in.set(t.Value, value)
+	case *parser.IndexExpression:
+		object := in.eval(t.Object)
+		index := in.evalValue(t.Index, in.info.TypeOf(t.Object).Key)
+		in.setElement(t, object, index, value)
+	default:
+		in.fail(target, "cannot assign to %s", target)
+	}
+}
+
+func (in *Interpreter) execFor(stmt *parser.ForStatement) control {
+	subject, indexed, items := stmt.Iterable, false, false
+	if call, ok := stmt.Iterable.(*parser.CallExpression); ok {
+		switch fn := call.Function.(type) {
+		case *parser.Identifier:
+			if fn.Value == "enumerate" && len(call.Arguments) == 1 && in.functions["enumerate"] == nil {
+				subject, indexed = call.Arguments[0], true
+			}
+		case *parser.MemberExpression:
+			if fn.Name == "items" && len(call.Arguments) == 0 {
+				subject, items = fn.Object, true
+			}
+		}
+	}
+
+	if r, ok := subject.(*parser.RangeExpression); ok && !indexed {
+		return in.execRangeLoop(stmt, r)
+	}
+
+	var elements []any
+	switch v := in.eval(subject).(type) {
+	case []any:
+		elements = v
+	case string:
+		for _, r := range v {
+			elements = append(elements, string(r))
+		}
+	case map[any]any:
+		elements = sortedKeys(v, in.info.TypeOf(subject))
+	default:
+		in.fail(subject, "cannot iterate over %s of type %s", subject, typeName(v))
+	}
+
+	for i, element := range elements {
+		switch {
+		case indexed:
+			in.set(stmt.Variable, i)
+			in.set(stmt.ValueVariable, element)
+		case items:
+			in.set(stmt.Variable, element)
+			in.set(stmt.ValueVariable, in.lookupValue(subject, element))
+		default:
+			in.set(stmt.Variable, element)
+		}
+		if done, c := in.loopBody(stmt.Body); done {
+			return c
+		}
+	}
+	return proceed
+}
+
+// lookupValue returns the value of a key in the map subject evaluates to,
+// for items(). A key deleted by the loop has the zero value, as in Go.
+func (in *Interpreter) lookupValue(subject parser.Expression, key any) any {
+	m, _ := in.eval(subject).(map[any]any)
+	if value, ok := m[key]; ok {
+		return value
+	}
+	return zeroValue(in.info.TypeOf(subject).Elem)
+}
+
+// execRangeLoop runs a counting loop. As in Python and the generated Go
+// loop, the start, stop and step are evaluated once, assigning to the loop
+// variable in the body does not move the loop along, and the variable
+// keeps the last value counted after the loop.
+func (in *Interpreter) execRangeLoop(stmt *parser.ForStatement, r *parser.RangeExpression) control {
+	i, step := 0, 1
+	if r.Start != nil {
+		i = in.intValue(r.Start)
+	}
+	stop := in.intValue(r.Stop)
+	if r.Step != nil {
+		step = in.intValue(r.Step)
+	}
+
+	for ; step > 0 && i < stop || step < 0 && i > stop; i += step {
+		in.set(stmt.Variable, i)
+		if done, c := in.loopBody(stmt.Body); done {
+			return c
+		}
+	}
+	return proceed
+}
+
+// variableType returns the type of a variable as seen from the code being
+// run
+func (in *Interpreter) variableType(name string) (*transpiler.Type, bool) {
+	if in.frame != nil {
+		if t, ok := in.info.VariableType(in.frame.function, name); ok {
+			return t, true
+		}
+	}
+	return in.info.VariableType("", name)
+}
+
+// set assigns a variable of the function being run, or of the main
+// program
+func (in *Interpreter) set(name string, value any) {
+	if in.frame != nil {
+		in.frame.locals[name] = value
+		return
+	}
+	in.globals[name] = value
+}
+
+// get returns the value of a variable, which is the zero value of its
+// type until it is first assigned, as for a Go variable declared with var.
+// Functions can read the variables of the main program.
+func (in *Interpreter) get(name string) any {
+	if in.frame != nil {
+		if value, ok := in.frame.locals[name]; ok {
+			return value
+		}
+		if t, ok := in.info.VariableType(in.frame.function, name); ok {
+			return zeroValue(t)
+		}
+	}
+	if value, ok := in.globals[name]; ok {
+		return value
+	}
+	t, _ := in.info.VariableType("", name)
+	return zeroValue(t)
+}
+
+// defined reports whether a name is a variable of the code being run
+func (in *Interpreter) defined(name string) bool {
+	if _, ok := in.globals[name]; ok {
+		return true
+	}
+	if in.frame != nil {
+		if _, ok := in.frame.locals[name]; ok {
+			return true
+		}
+	}
+	_, ok := in.variableType(name)
+	return ok
+}
@@ -0,0 +1,173 @@
+package interp
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/singleservingfriend/klo/transpiler"
+)
+
+// convert gives a value stored in a location of type target the Go type
+// of that location: an int stored as a float becomes a float64
+func convert(value any, target *transpiler.Type) any {
+	if n, ok := value.(int); ok && target != nil && target.Kind == transpiler.Float {
+		return float64(n)
+	}
+	return value
+}
+
+// zeroValue returns the value of a variable of type t that has not been
+// assigned yet
+func zeroValue(t *transpiler.Type) any {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind {
+	case transpiler.Int:
+		return 0
+	case transpiler.Float:
+		return 0.0
+	case transpiler.String:
+		return ""
+	case transpiler.Bool:
+		return false
+	case transpiler.List:
+		return []any(nil)
+	case transpiler.Map:
+		return map[any]any(nil)
+	default:
+		return nil
+	}
+}
+
+// truthy reports whether a value counts as true in a condition. Like in
+// Python, zero numbers, empty strings, lists and dicts and None are
+// false.
+func truthy(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []any:
+		return len(v) > 0
+	case map[any]any:
+		return len(v) > 0
+	}
+	return true
+}
+
+// typeName returns the klo name of the type of a value, for messages
+func typeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "None"
+	case bool:
+		return "bool"
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "str"
+	case []any:
+		return "list"
+	case map[any]any:
+		return "dict"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func isNumeric(t *transpiler.Type) bool {
+	return t.Kind == transpiler.Int || t.Kind == transpiler.Float
+}
+
+func isCollection(t *transpiler.Type) bool {
+	return t.Kind == transpiler.List || t.Kind == transpiler.Map
+}
+
+// sortedKeys returns the keys of a dict in the order a for loop visits
+// them: sorted by value when the key type is ordered, and by printed form
+// otherwise, as in the generated Go code
+func sortedKeys(m map[any]any, mapType *transpiler.Type) []any {
+	keys := make([]any, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	switch key := mapType.Key; {
+	case key != nil && (isNumeric(key) || key.Kind == transpiler.String):
+		slices.SortFunc(keys, compareOrdered)
+	default:
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+	}
+	return keys
+}
+
+// compareOrdered compares two ints, floats or strings
+func compareOrdered(a, b any) int {
+	switch x := a.(type) {
+	case int:
+		y, _ := b.(int)
+		return cmp.Compare(x, y)
+	case float64:
+		y, _ := b.(float64)
+		return cmp.Compare(x, y)
+	case string:
+		y, _ := b.(string)
+		return cmp.Compare(x, y)
+	}
+	return 0
+}
+
+// TypeOf returns the type of a variable holding value, for type checking a
+// program that uses variables it does not assign. The element type of a
+// list or dict joins the types of its elements; when they conflict it is
+// left unknown, so that operations on the elements are checked as they
+// run rather than rejected as operations on any.
+func TypeOf(value any) *transpiler.Type {
+	switch v := value.(type) {
+	case int:
+		return &transpiler.Type{Kind: transpiler.Int}
+	case float64:
+		return &transpiler.Type{Kind: transpiler.Float}
+	case string:
+		return &transpiler.Type{Kind: transpiler.String}
+	case bool:
+		return &transpiler.Type{Kind: transpiler.Bool}
+	case []any:
+		return &transpiler.Type{Kind: transpiler.List, Elem: elementType(v)}
+	case map[any]any:
+		keys, elements := make([]any, 0, len(v)), make([]any, 0, len(v))
+		for key, element := range v {
+			keys = append(keys, key)
+			elements = append(elements, element)
+		}
+		return &transpiler.Type{Kind: transpiler.Map, Key: elementType(keys), Elem: elementType(elements)}
+	case nil:
+		return &transpiler.Type{Kind: transpiler.Unknown}
+	}
+	return &transpiler.Type{Kind: transpiler.Any}
+}
+
+// elementType joins the types of the elements of a list or dict
+func elementType(elements []any) *transpiler.Type {
+	unknown := &transpiler.Type{Kind: transpiler.Unknown}
+	t := unknown
+	for _, element := range elements {
+		if t = transpiler.Join(t, TypeOf(element)); t.Kind == transpiler.Any {
+			return unknown
+		}
+	}
+	return t
+}
@@ -0,0 +1,275 @@
+package klo
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/singleservingfriend/klo/interp"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// toValue converts a Go value to a klo value: an int, float64, string,
+// bool, nil, []any or map[any]any. Structs become dicts keyed by the names
+// of their exported fields.
+func toValue(value any) (any, error) {
+	switch value.(type) {
+	case nil, int, float64, string, bool:
+		return value, nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		if int64(int(n)) != n {
+			return nil, fmt.Errorf("%d overflows int", n)
+		}
+		return int(n), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := v.Uint()
+		if n > math.MaxInt {
+			return nil, fmt.Errorf("%d overflows int", n)
+		}
+		return int(n), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return []any(nil), nil
+		}
+		list := make([]any, v.Len())
+		for i := range list {
+			element, err := toValue(v.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			list[i] = element
+		}
+		return list, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return map[any]any(nil), nil
+		}
+		dict := make(map[any]any, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			key, err := toValue(iter.Key().Interface())
+			if err != nil {
+				return nil, err
+			}
+			element, err := toValue(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = element
+		}
+		return dict, nil
+	case reflect.Struct:
+		dict := map[any]any{}
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			element, err := toValue(v.Field(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			dict[v.Type().Field(i).Name] = element
+		}
+		return dict, nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return toValue(v.Elem().Interface())
+	}
+	return nil, fmt.Errorf("cannot convert %T to a klo value", value)
+}
+
+// fromValue converts a klo value to the Go type t. Ints convert to any
+// integer type they fit in and to floats, lists to slices and arrays, and
+// dicts to maps and to structs with the fields named by their keys.
+func fromValue(value any, t reflect.Type) (reflect.Value, error) {
+	mismatch := func() (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("cannot use %s as %s", interp.TypeOf(value), t)
+	}
+
+	result := reflect.New(t).Elem()
+	if value == nil {
+		switch t.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Slice, reflect.Map:
+			return result, nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use None as %s", t)
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		v := reflect.ValueOf(value)
+		if !v.Type().Implements(t) {
+			return mismatch()
+		}
+		result.Set(v)
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return mismatch()
+		}
+		result.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := value.(int)
+		if !ok {
+			return mismatch()
+		}
+		if result.OverflowInt(int64(n)) {
+			return reflect.Value{}, fmt.Errorf("%d overflows %s", n, t)
+		}
+		result.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := value.(int)
+		if !ok {
+			return mismatch()
+		}
+		if n < 0 || result.OverflowUint(uint64(n)) {
+			return reflect.Value{}, fmt.Errorf("%d overflows %s", n, t)
+		}
+		result.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		switch n := value.(type) {
+		case int:
+			result.SetFloat(float64(n))
+		case float64:
+			result.SetFloat(n)
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return mismatch()
+		}
+		result.SetString(s)
+	case reflect.Slice, reflect.Array:
+		list, ok := value.([]any)
+		if !ok {
+			return mismatch()
+		}
+		if t.Kind() == reflect.Array && len(list) != t.Len() {
+			return reflect.Value{}, fmt.Errorf("cannot use a list of %d elements as %s", len(list), t)
+		}
+		if t.Kind() == reflect.Slice {
+			result = reflect.MakeSlice(t, len(list), len(list))
+		}
+		for i, element := range list {
+			v, err := fromValue(element, t.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			result.Index(i).Set(v)
+		}
+	case reflect.Map:
+		dict, ok := value.(map[any]any)
+		if !ok {
+			return mismatch()
+		}
+		result = reflect.MakeMapWithSize(t, len(dict))
+		for key, element := range dict {
+			k, err := fromValue(key, t.Key())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			v, err := fromValue(element, t.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			result.SetMapIndex(k, v)
+		}
+	case reflect.Struct:
+		dict, ok := value.(map[any]any)
+		if !ok {
+			return mismatch()
+		}
+		for key, element := range dict {
+			name, _ := key.(string)
+			field, ok := t.FieldByName(name)
+			if !ok || !field.IsExported() {
+				return reflect.Value{}, fmt.Errorf("%s has no field %v", t, key)
+			}
+			v, err := fromValue(element, field.Type)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			result.FieldByIndex(field.Index).Set(v)
+		}
+	case reflect.Pointer:
+		v, err := fromValue(value, t.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		result = reflect.New(t.Elem())
+		result.Elem().Set(v)
+	default:
+		return mismatch()
+	}
+	return result, nil
+}
+
+// wrapFunction turns a Go function into one the interpreter can call,
+// converting its arguments from klo values and its result to a klo value
+func wrapFunction(fn any) (interp.Builtin, error) {
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func || f.IsNil() {
+		return nil, fmt.Errorf("%T is not a function", fn)
+	}
+	t := f.Type()
+
+	// The results are nothing, a value, an error, or a value and an error
+	returnsError := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+	values := t.NumOut()
+	if returnsError {
+		values--
+	}
+	if values > 1 {
+		return nil, errors.New("a function called from klo returns at most one value and an error")
+	}
+
+	return func(args []any) (any, error) {
+		params := t.NumIn()
+		switch {
+		case t.IsVariadic() && len(args) < params-1:
+			return nil, fmt.Errorf("takes at least %d arguments, got %d", params-1, len(args))
+		case !t.IsVariadic() && len(args) != params:
+			return nil, fmt.Errorf("takes %d arguments, got %d", params, len(args))
+		}
+
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			param := t.In(min(i, params-1))
+			if t.IsVariadic() && i >= params-1 {
+				param = param.Elem()
+			}
+			v, err := fromValue(arg, param)
+			if err != nil {
+				return nil, fmt.Errorf("argument %d: %v", i+1, err)
+			}
+			in[i] = v
+		}
+
+		out := f.Call(in)
+		if returnsError {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return nil, err
+			}
+		}
+		if values == 0 {
+			return nil, nil
+		}
+		return toValue(out[0].Interface())
+	}, nil
+}
@@ -0,0 +1,182 @@
+// Package klo embeds the klo language in Go programs. A VM runs klo code
+// with the interpreter, so no Go toolchain, subprocess or temporary file
+// is involved:
+//
+//	vm := klo.New()
+//	vm.Set("order", map[string]any{"total": 120, "country": "NL"})
+//	vm.Register("log", func(message string) { log.Println(message) })
+//	err := vm.Exec(`
+//	discount = 0
+//	if order["total"] > 100:
+//	  discount = 10
+//	  log(f"discount for an order of {order['total']}")
+//	`)
+//	discount := vm.Get("discount") // 10
+//
+// Go values are converted to klo values when they are set and when a Go
+// function returns them, and klo values to the parameter types of a Go
+// function when klo code calls it.
+package klo
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/singleservingfriend/klo/interp"
+	"github.com/singleservingfriend/klo/parser"
+	"github.com/singleservingfriend/klo/transpiler"
+)
+
+// VM runs klo code and holds its variables and functions from one Exec to
+// the next. A VM must not be used by several goroutines at once.
+type VM struct {
+	interpreter *interp.Interpreter
+	functions   []*parser.FunctionDefinition // defs of the code run so far
+	registered  map[string]bool              // names of the Go functions registered
+	out         io.Writer
+}
+
+// builtins are the functions klo code can call without defining them,
+// which the type checker knows the parameters of
+var builtins = map[string]bool{"len": true, "enumerate": true, "range": true}
+
+// New returns a VM with no variables, whose print statements write to
+// standard output
+func New() *VM {
+	vm := &VM{out: os.Stdout, registered: map[string]bool{}}
+	vm.interpreter = interp.New(output{vm})
+	return vm
+}
+
+// output writes to the current output of a VM, so that SetOutput applies
+// to the interpreter already created
+type output struct {
+	vm *VM
+}
+
+func (o output) Write(p []byte) (int, error) {
+	return o.vm.out.Write(p)
+}
+
+// SetOutput sets where print statements write
+func (vm *VM) SetOutput(w io.Writer) {
+	vm.out = w
+}
+
+// Set assigns a variable that klo code can use. Go numbers become ints
+// and floats, slices and arrays become lists, and maps and structs become
+// dicts; Set fails for values klo has no counterpart for, such as
+// channels.
+func (vm *VM) Set(name string, value any) error {
+	if !isName(name) {
+		return fmt.Errorf("%q is not a valid klo name", name)
+	}
+	v, err := toValue(value)
+	if err != nil {
+		return fmt.Errorf("cannot set %s: %v", name, err)
+	}
+	vm.interpreter.SetGlobal(name, v)
+	return nil
+}
+
+// Register makes a Go function callable from klo code under name. The
+// function may take any parameters klo values convert to, be variadic,
+// and return nothing, a value, an error, or a value and an error. A
+// returned error stops the klo code with a runtime error at the call, while
+// a panic goes on up through Exec with the stack of fn. The name must not
+// be that of a builtin such as len, or of a def of the code run so far.
+func (vm *VM) Register(name string, fn any) error {
+	if !isName(name) {
+		return fmt.Errorf("%q is not a valid klo name", name)
+	}
+	if builtins[name] {
+		return fmt.Errorf("cannot register %s: it is a builtin function", name)
+	}
+	for _, def := range vm.functions {
+		if def.Name == name {
+			return fmt.Errorf("cannot register %s: it is a function defined by klo code", name)
+		}
+	}
+	builtin, err := wrapFunction(fn)
+	if err != nil {
+		return fmt.Errorf("cannot register %s: %v", name, err)
+	}
+	vm.interpreter.Define(name, builtin)
+	vm.registered[name] = true
+	return nil
+}
+
+// Exec runs klo source code. The variables it assigns and the functions it
+// defines are kept for later calls. Syntax, type and runtime errors are
+// returned as parser.Diagnostics, at lines of src.
+func (vm *VM) Exec(src string) error {
+	program, err := parser.Parse(src)
+	if err != nil {
+		return err
+	}
+
+	// Functions defined by earlier code are checked along with this code,
+	// unless it defines them again. Registered Go functions cannot be
+	// defined again.
+	defined := map[string]bool{}
+	var diagnostics parser.Diagnostics
+	for _, stmt := range program.Statements {
+		if def, ok := stmt.(*parser.FunctionDefinition); ok {
+			defined[def.Name] = true
+			if vm.registered[def.Name] {
+				diagnostics = append(diagnostics, parser.Errorf(parser.SpanOf(def), parser.CodeRedefined,
+					"function %s is already registered by the Go program", def.Name))
+			}
+		}
+	}
+	if len(diagnostics) > 0 {
+		return diagnostics
+	}
+	var earlier []parser.Statement
+	for _, def := range vm.functions {
+		if !defined[def.Name] {
+			earlier = append(earlier, def)
+		}
+	}
+	program.Statements = append(earlier, program.Statements...)
+
+	// Variables get the types of the values they hold, and registered Go
+	// functions are globals that can be called with any arguments
+	globals := map[string]*transpiler.Type{}
+	for name := range vm.registered {
+		globals[name] = &transpiler.Type{Kind: transpiler.Function}
+	}
+	for _, name := range vm.interpreter.Globals() {
+		value, _ := vm.interpreter.Global(name)
+		globals[name] = interp.TypeOf(value)
+	}
+
+	info, err := transpiler.CheckWithGlobals(program, globals)
+	if err != nil {
+		return err
+	}
+
+	vm.functions = vm.functions[:0]
+	for _, stmt := range program.Statements {
+		if def, ok := stmt.(*parser.FunctionDefinition); ok {
+			vm.functions = append(vm.functions, def)
+		}
+	}
+	return vm.interpreter.RunFrom(program, info, len(earlier))
+}
+
+// Get returns the value of a variable: an int, float64, string, bool, nil,
+// []any or map[any]any. It is nil for a variable that has not been set or
+// assigned.
+func (vm *VM) Get(name string) any {
+	value, _ := vm.interpreter.Global(name)
+	return value
+}
+
+// isName reports whether name can be used as a klo variable or function
+func isName(name string) bool {
+	tokens, err := parser.NewLexer(name).Tokenize()
+	return err == nil && len(tokens) > 1 &&
+		tokens[0].Type == parser.IDENTIFIER && tokens[0].Value == name && tokens[1].Type == parser.NEWLINE
+}
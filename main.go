@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 
-	"github.com/urfave/cli/v2"
+	"github.com/singleservingfriend/klo/interp"
 	"github.com/singleservingfriend/klo/parser"
 	"github.com/singleservingfriend/klo/transpiler"
+	"github.com/urfave/cli/v2"
 )
 
 func main() {
@@ -18,7 +24,7 @@ func main() {
 		Name:        "klo",
 		Usage:       "A minimalist programming language built on Go",
 		Version:     "0.1.0",
-		Description: "klo transpiles simple, Python-like syntax to Go and executes it",
+		Description: "klo runs simple, Python-like programs, and compiles them to Go",
 		Action:      runKloFile,
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
@@ -27,16 +33,39 @@ func main() {
 				Usage:   "Only transpile to Go, don't execute",
 			},
 			&cli.BoolFlag{
-				Name:    "verbose",
-				Usage:   "Show verbose output",
+				Name:  "verbose",
+				Usage: "Show verbose output",
 			},
 			&cli.StringFlag{
 				Name:    "output",
 				Aliases: []string{"o"},
 				Usage:   "Output file for transpiled Go code",
 			},
+			&cli.StringFlag{
+				Name:  "error-format",
+				Value: "text",
+				Usage: "Format of errors and warnings: text or json",
+			},
 		},
 		Commands: []*cli.Command{
+			{
+				Name:      "build",
+				Usage:     "Compile a program to an executable with the Go toolchain",
+				ArgsUsage: "file.klo",
+				Action:    buildKloFile,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Name of the executable",
+					},
+				},
+			},
+			{
+				Name:   "repl",
+				Usage:  "Run klo statements interactively",
+				Action: startRepl,
+			},
 			{
 				Name:    "version",
 				Aliases: []string{"v"},
@@ -60,19 +89,56 @@ func runKloFile(c *cli.Context) error {
 	}
 
 	filePath := c.Args().Get(0)
+	source, ast, err := parseKloFile(c, filePath)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("transpile") {
+		return transpileKloFile(c, filePath, source, ast)
+	}
+
+	info, err := transpiler.Check(ast)
+	if err != nil {
+		return reportError(c, filePath, source, "type error", err)
+	}
+	reportDiagnostics(c, filePath, source, info.Warnings)
+
+	if c.Bool("verbose") {
+		fmt.Println("Running...")
+	}
+
+	// Output is flushed before a runtime error is reported, so that the
+	// error comes after everything the program printed
+	stdout := bufio.NewWriter(os.Stdout)
+	err = interp.New(stdout).Run(ast, info)
+	stdout.Flush()
+	if err != nil {
+		return reportError(c, filePath, source, "runtime error", err)
+	}
+
+	return nil
+}
+
+// parseKloFile reads and parses a klo program
+func parseKloFile(c *cli.Context, filePath string) (string, *parser.Program, error) {
 	if !strings.HasSuffix(filePath, ".klo") {
-		return fmt.Errorf("file must have .klo extension")
+		return "", nil, fmt.Errorf("file must have .klo extension")
+	}
+
+	if format := c.String("error-format"); format != "text" && format != "json" {
+		return "", nil, fmt.Errorf("unknown error format %q, expected text or json", format)
 	}
 
 	// Check if file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("file does not exist: %s", filePath)
+		return "", nil, fmt.Errorf("file does not exist: %s", filePath)
 	}
 
 	// Read the klo source code
 	source, err := os.ReadFile(filePath)
 	if err != nil {
-		return fmt.Errorf("error reading file: %v", err)
+		return "", nil, fmt.Errorf("error reading file: %v", err)
 	}
 
 	if c.Bool("verbose") {
@@ -83,62 +149,185 @@ func runKloFile(c *cli.Context) error {
 	// Parse the klo code
 	ast, err := parser.Parse(string(source))
 	if err != nil {
-		return fmt.Errorf("parse error: %v", err)
+		return "", nil, reportError(c, filePath, string(source), "parse error", err)
 	}
+	return string(source), ast, nil
+}
+
+// goFileName returns the name of the Go file generated for a klo file
+// when no output file is given
+func goFileName(filePath string) string {
+	baseName := strings.TrimSuffix(filepath.Base(filePath), ".klo")
+	// Avoid _test suffix which Go treats as test files
+	if strings.HasSuffix(baseName, "_test") {
+		baseName = strings.TrimSuffix(baseName, "_test") + "_example"
+	}
+	return fmt.Sprintf("klo_temp_%s.go", baseName)
+}
 
+// writeGoFile transpiles a program and writes the Go code to outputFile
+func writeGoFile(c *cli.Context, filePath, source string, ast *parser.Program, outputFile string) (*transpiler.Result, error) {
 	if c.Bool("verbose") {
 		fmt.Println("Transpiling to Go...")
 	}
 
-	// Generate Go code
-	goCode := transpiler.GenerateGoCode(ast)
-
-	// Determine output file
-	outputFile := c.String("output")
-	if outputFile == "" {
-		// Create temporary file
-		baseName := strings.TrimSuffix(filepath.Base(filePath), ".klo")
-		// Avoid _test suffix which Go treats as test files
-		if strings.HasSuffix(baseName, "_test") {
-			baseName = strings.TrimSuffix(baseName, "_test") + "_example"
-		}
-		outputFile = fmt.Sprintf("klo_temp_%s.go", baseName)
+	// Generate Go code, with //line directives naming the klo file
+	// relative to the Go file
+	result, err := transpiler.TranspileFile(ast, relativePath(filepath.Dir(outputFile), filePath))
+	if err != nil {
+		return nil, reportError(c, filePath, source, "transpile error", err)
 	}
+	reportDiagnostics(c, filePath, source, result.Warnings)
 
 	// Write Go code to file
-	err = os.WriteFile(outputFile, []byte(goCode), 0644)
+	err = os.WriteFile(outputFile, []byte(result.Code), 0644)
 	if err != nil {
-		return fmt.Errorf("error writing Go file: %v", err)
+		return nil, fmt.Errorf("error writing Go file: %v", err)
 	}
 
 	if c.Bool("verbose") {
 		fmt.Printf("Generated Go code written to: %s\n", outputFile)
 	}
+	return result, nil
+}
 
-	// If only transpiling, stop here
-	if c.Bool("transpile") {
-		fmt.Printf("Transpiled %s to %s\n", filePath, outputFile)
-		return nil
+// transpileKloFile writes the Go code of a program without running it
+func transpileKloFile(c *cli.Context, filePath, source string, ast *parser.Program) error {
+	outputFile := c.String("output")
+	if outputFile == "" {
+		outputFile = goFileName(filePath)
 	}
 
-	// Execute the Go code
+	if _, err := writeGoFile(c, filePath, source, ast, outputFile); err != nil {
+		return err
+	}
+	fmt.Printf("Transpiled %s to %s\n", filePath, outputFile)
+	return nil
+}
+
+// buildKloFile compiles a program to an executable by transpiling it to
+// Go and running go build
+func buildKloFile(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return cli.ShowSubcommandHelp(c)
+	}
+
+	filePath := c.Args().Get(0)
+	source, ast, err := parseKloFile(c, filePath)
+	if err != nil {
+		return err
+	}
+
+	executable := c.String("output")
+	if executable == "" {
+		executable = strings.TrimSuffix(filepath.Base(filePath), ".klo")
+		if runtime.GOOS == "windows" {
+			executable += ".exe"
+		}
+	}
+
+	goFile := goFileName(filePath)
+	result, err := writeGoFile(c, filePath, source, ast, goFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(goFile)
+
 	if c.Bool("verbose") {
-		fmt.Println("Executing Go code...")
+		fmt.Println("Compiling Go code...")
 	}
 
-	cmd := exec.Command("go", "run", outputFile)
+	// Compiler errors in the generated code are reported at klo positions
+	stderr := &positionRewriter{
+		out:       os.Stderr,
+		sourceMap: result.SourceMap,
+		goFile:    goFile,
+		kloFile:   filePath,
+	}
+	cmd := exec.Command("go", "build", "-o", executable, goFile)
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = stderr
 	err = cmd.Run()
+	stderr.Flush()
+
+	if err != nil {
+		return fmt.Errorf("build error: %v", err)
+	}
+
+	fmt.Printf("Built %s from %s\n", executable, filePath)
+	return nil
+}
 
-	// Clean up temporary file if it was auto-generated
-	if c.String("output") == "" {
-		os.Remove(outputFile)
+// reportDiagnostics prints diagnostics to stderr in the format chosen with
+// --error-format
+func reportDiagnostics(c *cli.Context, filePath, source string, diagnostics []parser.Diagnostic) {
+	for _, diagnostic := range diagnostics {
+		if c.String("error-format") == "json" {
+			fmt.Fprintln(os.Stderr, diagnostic.JSON(filePath))
+		} else {
+			fmt.Fprint(os.Stderr, diagnostic.Render(filePath, source))
+		}
 	}
+}
 
+// reportError prints the diagnostics of a failed stage and exits with
+// status 1. Other errors are returned as they are, prefixed by stage.
+func reportError(c *cli.Context, filePath, source, stage string, err error) error {
+	var diagnostics parser.Diagnostics
+	if !errors.As(err, &diagnostics) {
+		return fmt.Errorf("%s: %v", stage, err)
+	}
+	reportDiagnostics(c, filePath, source, diagnostics)
+	return cli.Exit("", 1)
+}
+
+// relativePath returns path relative to dir when it can be expressed that
+// way, and path itself otherwise
+func relativePath(dir, path string) string {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return path
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(absDir, absPath)
 	if err != nil {
-		return fmt.Errorf("execution error: %v", err)
+		return path
 	}
+	return filepath.ToSlash(rel)
+}
 
-	return nil
+// positionRewriter copies the output of the Go toolchain line by line,
+// rewriting positions in the generated Go file into klo positions
+type positionRewriter struct {
+	out       io.Writer
+	sourceMap *transpiler.SourceMap
+	goFile    string
+	kloFile   string
+	pending   []byte // an incomplete last line
+}
+
+func (w *positionRewriter) Write(data []byte) (int, error) {
+	w.pending = append(w.pending, data...)
+	for {
+		end := bytes.IndexByte(w.pending, '\n')
+		if end < 0 {
+			return len(data), nil
+		}
+		line := w.sourceMap.Rewrite(string(w.pending[:end+1]), w.goFile, w.kloFile)
+		w.pending = w.pending[end+1:]
+		if _, err := io.WriteString(w.out, line); err != nil {
+			return len(data), err
+		}
+	}
+}
+
+// Flush writes out an incomplete last line
+func (w *positionRewriter) Flush() {
+	if len(w.pending) > 0 {
+		io.WriteString(w.out, w.sourceMap.Rewrite(string(w.pending), w.goFile, w.kloFile))
+		w.pending = nil
+	}
 }
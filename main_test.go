@@ -1,28 +1,39 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go/format"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/singleservingfriend/klo/interp"
+	"github.com/singleservingfriend/klo/klo"
 	"github.com/singleservingfriend/klo/parser"
 	"github.com/singleservingfriend/klo/transpiler"
 )
 
 func TestBasicParsing(t *testing.T) {
 	source := `print "Hello, World!"`
-	
+
 	program, err := parser.Parse(source)
 	if err != nil {
 		t.Fatalf("Parse error: %v", err)
 	}
-	
+
 	if len(program.Statements) != 1 {
 		t.Fatalf("Expected 1 statement, got %d", len(program.Statements))
 	}
-	
+
 	printStmt, ok := program.Statements[0].(*parser.PrintStatement)
 	if !ok {
 		t.Fatalf("Expected PrintStatement, got %T", program.Statements[0])
 	}
-	
+
 	if len(printStmt.Arguments) != 1 {
 		t.Fatalf("Expected 1 argument, got %d", len(printStmt.Arguments))
 	}
@@ -30,21 +41,21 @@ func TestBasicParsing(t *testing.T) {
 
 func TestVariableAssignment(t *testing.T) {
 	source := `x = 42`
-	
+
 	program, err := parser.Parse(source)
 	if err != nil {
 		t.Fatalf("Parse error: %v", err)
 	}
-	
+
 	if len(program.Statements) != 1 {
 		t.Fatalf("Expected 1 statement, got %d", len(program.Statements))
 	}
-	
+
 	assignStmt, ok := program.Statements[0].(*parser.AssignmentStatement)
 	if !ok {
 		t.Fatalf("Expected AssignmentStatement, got %T", program.Statements[0])
 	}
-	
+
 	if assignStmt.Name != "x" {
 		t.Fatalf("Expected variable name 'x', got '%s'", assignStmt.Name)
 	}
@@ -52,21 +63,21 @@ func TestVariableAssignment(t *testing.T) {
 
 func TestArithmetic(t *testing.T) {
 	source := `result = 5 + 3 * 2`
-	
+
 	program, err := parser.Parse(source)
 	if err != nil {
 		t.Fatalf("Parse error: %v", err)
 	}
-	
+
 	if len(program.Statements) != 1 {
 		t.Fatalf("Expected 1 statement, got %d", len(program.Statements))
 	}
-	
+
 	assignStmt, ok := program.Statements[0].(*parser.AssignmentStatement)
 	if !ok {
 		t.Fatalf("Expected AssignmentStatement, got %T", program.Statements[0])
 	}
-	
+
 	_, ok = assignStmt.Value.(*parser.BinaryExpression)
 	if !ok {
 		t.Fatalf("Expected BinaryExpression, got %T", assignStmt.Value)
@@ -76,53 +87,1635 @@ func TestArithmetic(t *testing.T) {
 func TestForLoop(t *testing.T) {
 	source := `for i in range(5):
   print i`
-	
+
 	program, err := parser.Parse(source)
 	if err != nil {
 		t.Fatalf("Parse error: %v", err)
 	}
-	
+
 	if len(program.Statements) != 1 {
 		t.Fatalf("Expected 1 statement, got %d", len(program.Statements))
 	}
-	
+
 	forStmt, ok := program.Statements[0].(*parser.ForStatement)
 	if !ok {
 		t.Fatalf("Expected ForStatement, got %T", program.Statements[0])
 	}
-	
+
 	if forStmt.Variable != "i" {
 		t.Fatalf("Expected variable name 'i', got '%s'", forStmt.Variable)
 	}
 }
 
+func TestIndentedBlocks(t *testing.T) {
+	source := `if x > 3:
+  print "big"
+  if x > 4:
+    print "bigger"
+    print "still"
+  print "after nested"
+else:
+  print "small"
+print "done"`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("Expected 2 statements, got %d", len(program.Statements))
+	}
+
+	ifStmt, ok := program.Statements[0].(*parser.IfStatement)
+	if !ok {
+		t.Fatalf("Expected IfStatement, got %T", program.Statements[0])
+	}
+
+	body := ifStmt.Branches[0].Body
+	if len(body) != 3 {
+		t.Fatalf("Expected 3 statements in if body, got %d", len(body))
+	}
+
+	nested, ok := body[1].(*parser.IfStatement)
+	if !ok {
+		t.Fatalf("Expected nested IfStatement, got %T", body[1])
+	}
+
+	if len(nested.Branches[0].Body) != 2 {
+		t.Fatalf("Expected 2 statements in nested body, got %d", len(nested.Branches[0].Body))
+	}
+
+	if len(ifStmt.Else) != 1 {
+		t.Fatalf("Expected 1 statement in else body, got %d", len(ifStmt.Else))
+	}
+}
+
+func TestInconsistentDedent(t *testing.T) {
+	source := `if x > 0:
+    print x
+  print x`
+
+	_, err := parser.Parse(source)
+	if err == nil {
+		t.Fatal("Expected an error for inconsistent dedent")
+	}
+
+	if !strings.Contains(err.Error(), "line 3, column 3") {
+		t.Fatalf("Expected error to mention line 3, column 3, got: %v", err)
+	}
+}
+
 func TestTranspilation(t *testing.T) {
 	source := `x = 42
 print x`
-	
+
 	program, err := parser.Parse(source)
 	if err != nil {
 		t.Fatalf("Parse error: %v", err)
 	}
-	
-	goCode := transpiler.GenerateGoCode(program)
-	
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
 	// Basic checks that Go code was generated
 	if len(goCode) == 0 {
 		t.Fatal("No Go code generated")
 	}
-	
+
 	// Should contain package declaration
-	if !contains(goCode, "package main") {
+	if !strings.Contains(goCode, "package main") {
 		t.Fatal("Generated code missing package declaration")
 	}
-	
+
 	// Should contain main function
-	if !contains(goCode, "func main()") {
+	if !strings.Contains(goCode, "func main()") {
 		t.Fatal("Generated code missing main function")
 	}
 }
 
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && s[0:len(substr)] == substr || len(s) > len(substr) && contains(s[1:], substr)
+func TestFunctionDefinition(t *testing.T) {
+	source := `def fib(n):
+  if n < 2:
+    return n
+  return fib(n - 1) + fib(n - 2)
+
+print fib(10)`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	def, ok := program.Statements[0].(*parser.FunctionDefinition)
+	if !ok {
+		t.Fatalf("Expected FunctionDefinition, got %T", program.Statements[0])
+	}
+
+	if def.Name != "fib" || len(def.Parameters) != 1 || len(def.Body) != 2 {
+		t.Fatalf("Unexpected function definition: %s(%v) with %d statements", def.Name, def.Parameters, len(def.Body))
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	// Parameter and result types are inferred from the call fib(10)
+	if !strings.Contains(goCode, "func fib(n int) int {") {
+		t.Fatalf("Expected typed top-level function, got:\n%s", goCode)
+	}
+}
+
+func TestDuplicateFunction(t *testing.T) {
+	source := `def f(x):
+  return x
+
+def f(x):
+  return "a"
+
+print f(1)`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	_, err = transpiler.Transpile(program)
+	var diagnostics parser.Diagnostics
+	if !errors.As(err, &diagnostics) || len(diagnostics) != 1 {
+		t.Fatalf("Expected one diagnostic, got %v", err)
+	}
+	if d := diagnostics[0]; d.Code != parser.CodeRedefined || d.Span.From.Line != 4 ||
+		d.Message != "function f is already defined at line 1" {
+		t.Fatalf("Expected a redefinition error at line 4, got %v", d)
+	}
+}
+
+func TestReturnOutsideFunction(t *testing.T) {
+	_, err := parser.Parse("return 5")
+	if err == nil {
+		t.Fatal("Expected an error for return outside a function")
+	}
+}
+
+func TestWhileLoop(t *testing.T) {
+	source := `x = 0
+while x < 10:
+  if x == 5:
+    break
+  continue`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	whileStmt, ok := program.Statements[1].(*parser.WhileStatement)
+	if !ok {
+		t.Fatalf("Expected WhileStatement, got %T", program.Statements[1])
+	}
+
+	if len(whileStmt.Body) != 2 {
+		t.Fatalf("Expected 2 statements in while body, got %d", len(whileStmt.Body))
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+	if !strings.Contains(goCode, "for x < 10 {") {
+		t.Fatalf("Expected a Go for loop with condition, got:\n%s", goCode)
+	}
+}
+
+func TestLoopControlOutsideLoop(t *testing.T) {
+	sources := []string{
+		"break",
+		"if x > 0:\n  continue",
+		"for i in range(3):\n  print i\nbreak",
+	}
+
+	for _, source := range sources {
+		if _, err := parser.Parse(source); err == nil {
+			t.Fatalf("Expected an error for loop control outside a loop in %q", source)
+		}
+	}
+}
+
+func TestElifChain(t *testing.T) {
+	source := `score = 75
+if score >= 90:
+  grade = "A"
+elif score >= 80:
+  grade = "B"
+elif score >= 70: grade = "C"
+else:
+  grade = "F"`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("Expected 2 statements, got %d", len(program.Statements))
+	}
+
+	ifStmt, ok := program.Statements[1].(*parser.IfStatement)
+	if !ok {
+		t.Fatalf("Expected IfStatement, got %T", program.Statements[1])
+	}
+
+	if len(ifStmt.Branches) != 3 || len(ifStmt.Else) != 1 {
+		t.Fatalf("Expected 3 branches and an else, got %d branches and %d else statements", len(ifStmt.Branches), len(ifStmt.Else))
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+	if !strings.Contains(goCode, "} else if score >= 70 {") {
+		t.Fatalf("Expected a flat else-if chain, got:\n%s", goCode)
+	}
+}
+
+func TestLists(t *testing.T) {
+	source := `nums = [1, 2, 3]
+nums.append(4)
+nums[0] = 10
+print nums[1], len(nums)
+mixed = [1, 2.5]
+names = []
+names.append("klo")
+other = [1, "a"]`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	assignStmt, ok := program.Statements[0].(*parser.AssignmentStatement)
+	if !ok {
+		t.Fatalf("Expected AssignmentStatement, got %T", program.Statements[0])
+	}
+
+	list, ok := assignStmt.Value.(*parser.ListLiteral)
+	if !ok || len(list.Elements) != 3 {
+		t.Fatalf("Expected a list literal with 3 elements, got %v", assignStmt.Value)
+	}
+
+	if _, ok := program.Statements[2].(*parser.IndexAssignmentStatement); !ok {
+		t.Fatalf("Expected IndexAssignmentStatement, got %T", program.Statements[2])
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	expected := []string{
+		"nums := []int{1, 2, 3}",
+		"nums = append(nums, 4)",
+		"nums[0] = 10",
+		"len(nums)",
+		"mixed := []float64{1, 2.5}",
+		"names := []string{}",
+		"other := []any{1, \"a\"}",
+	}
+	for _, want := range expected {
+		if !strings.Contains(goCode, want) {
+			t.Fatalf("Expected generated code to contain %q, got:\n%s", want, goCode)
+		}
+	}
+}
+
+func TestDictionaries(t *testing.T) {
+	source := `ages = {
+  "bob": 30,
+  "alice": 25,
+}
+ages["carol"] = 35
+del ages["bob"]
+print ages["alice"], "alice" in ages
+for name in ages:
+  print name`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	if len(program.Statements) != 5 {
+		t.Fatalf("Expected 5 statements, got %d", len(program.Statements))
+	}
+
+	assignStmt := program.Statements[0].(*parser.AssignmentStatement)
+	dict, ok := assignStmt.Value.(*parser.DictLiteral)
+	if !ok || len(dict.Entries) != 2 {
+		t.Fatalf("Expected a dict literal with 2 entries, got %v", assignStmt.Value)
+	}
+
+	if _, ok := program.Statements[2].(*parser.DeleteStatement); !ok {
+		t.Fatalf("Expected DeleteStatement, got %T", program.Statements[2])
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	expected := []string{
+		`ages := map[string]int{"bob": 30, "alice": 25}`,
+		`ages["carol"] = 35`,
+		`delete(ages, "bob")`,
+		`kloLookup(ages, "alice")`,
+		`kloHasKey(ages, "alice")`,
+		`for _, name := range kloSortedKeys(ages) {`,
+	}
+	for _, want := range expected {
+		if !strings.Contains(goCode, want) {
+			t.Fatalf("Expected generated code to contain %q, got:\n%s", want, goCode)
+		}
+	}
+}
+
+func TestAppendToMapElement(t *testing.T) {
+	source := `d = {"a": [1]}
+d["a"].append(2)
+nested = [[1], [2]]
+nested[1].append(3)
+print d, nested`
+
+	if got, want := runGo(t, source), "map[a:[1 2]] [[1] [2 3]]\n"; got != want {
+		t.Fatalf("Expected output %q, got %q", want, got)
+	}
+}
+
+func TestForInLoops(t *testing.T) {
+	source := `xs = [10, 20]
+d = {"a": 1}
+for x in xs:
+  print x
+for ch in "text":
+  print ch
+for k, v in d.items():
+  print k, v
+for i, x in enumerate(xs):
+  print i, x`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	forStmt := program.Statements[4].(*parser.ForStatement)
+	if forStmt.Variable != "k" || forStmt.ValueVariable != "v" {
+		t.Fatalf("Expected loop variables k, v, got %s, %s", forStmt.Variable, forStmt.ValueVariable)
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	expected := []string{
+		"for _, x := range xs {",
+		`for _, kloRune := range "text" {`,
+		"ch := string(kloRune)",
+		"for _, k := range kloSortedKeys(d) {",
+		"v := d[k]",
+		"for i, x := range xs {",
+	}
+	for _, want := range expected {
+		if !strings.Contains(goCode, want) {
+			t.Fatalf("Expected generated code to contain %q, got:\n%s", want, goCode)
+		}
+	}
+}
+
+func TestLoopVariablesAfterLoop(t *testing.T) {
+	source := `i = 100
+for i in range(3):
+  print "-"
+print i
+for x in [1, 2]:
+  print x
+print x
+n = 0
+for n in range(0):
+  print "-"
+print n
+for j in range(2):
+  print j
+for j in range(2):
+  print j
+for k, v in {"a": 1}.items():
+  print "-"
+print k, v
+def last(a):
+  for a in range(a):
+    print "-"
+  return a
+print last(2)`
+
+	want := "- - - 2 1 2 2 0 0 1 0 1 - a 1 - - 1 "
+	if got := strings.ReplaceAll(runGo(t, source), "\n", " "); got != want {
+		t.Fatalf("Expected output %q, got %q", want, got)
+	}
+}
+
+func TestUnsupportedIterable(t *testing.T) {
+	source := `count = 5
+for i in count:
+  print i`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	_, err = transpiler.GenerateGoCode(program)
+	if err == nil {
+		t.Fatal("Expected an error for iterating over an int")
+	}
+
+	if !strings.Contains(err.Error(), "cannot iterate over count") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestRangeArguments(t *testing.T) {
+	source := `for num in range(1, 6):
+  print num
+for i in range(0, 10, 3):
+  print i
+step = 0 - 1
+for i in range(5, 0, step):
+  print i
+evens = range(0, 10, 2)`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	forStmt := program.Statements[1].(*parser.ForStatement)
+	rangeExpr, ok := forStmt.Iterable.(*parser.RangeExpression)
+	if !ok {
+		t.Fatalf("Expected RangeExpression, got %T", forStmt.Iterable)
+	}
+
+	if rangeExpr.Start == nil || rangeExpr.Stop == nil || rangeExpr.Step == nil {
+		t.Fatalf("Expected start, stop and step, got %+v", rangeExpr)
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	expected := []string{
+		"for num := 1; num < 6; num++ {",
+		"for i := 0; i < 10; i += 3 {",
+		"for i, kloStep := 5, step; (kloStep > 0 && i < 0) || (kloStep < 0 && i > 0); i += kloStep {",
+		"evens := kloRange(0, 10, 2)",
+	}
+	for _, want := range expected {
+		if !strings.Contains(goCode, want) {
+			t.Fatalf("Expected generated code to contain %q, got:\n%s", want, goCode)
+		}
+	}
+
+	if _, err := parser.Parse("for i in range(1, 2, 3, 4):\n  print i"); err == nil {
+		t.Fatal("Expected an error for range() with 4 arguments")
+	}
+}
+
+func TestLogicalAndUnaryOperators(t *testing.T) {
+	source := `x = -5
+ready = not False and x < 0 or True
+items = [1]
+if items:
+  print "has items"
+while x:
+  break`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	unary, ok := program.Statements[0].(*parser.AssignmentStatement).Value.(*parser.UnaryExpression)
+	if !ok || unary.Operator != "-" {
+		t.Fatalf("Expected unary minus, got %v", program.Statements[0].(*parser.AssignmentStatement).Value)
+	}
+
+	// "or" binds loosest, then "and", then "not"
+	ready := program.Statements[1].(*parser.AssignmentStatement).Value
+	if ready.String() != "(((not False) and (x < 0)) or True)" {
+		t.Fatalf("Unexpected precedence: %s", ready)
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	expected := []string{
+		"x := -5",
+		"ready := !false && x < 0 || true",
+		"if len(items) > 0 {",
+		"for x != 0 {",
+	}
+	for _, want := range expected {
+		if !strings.Contains(goCode, want) {
+			t.Fatalf("Expected generated code to contain %q, got:\n%s", want, goCode)
+		}
+	}
+}
+
+func TestLogicalOperatorsProduceBools(t *testing.T) {
+	// Unlike Python, and and or give a bool rather than an operand
+	source := "x = 2\nname = \"\"\nprint x and 3, 0 or \"a\", name or 0\nlabel = name or \"anonymous\"\nprint label"
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	info, err := transpiler.Check(program)
+	if err != nil {
+		t.Fatalf("Check error: %v", err)
+	}
+	label := program.Statements[3].(*parser.AssignmentStatement).Value
+	if got := info.TypeOf(label); got.Kind != transpiler.Bool {
+		t.Fatalf("Expected %s to be a bool, got %s", label, got)
+	}
+
+	want := "true true false\ntrue\n"
+	interpreted, err := interpret(source)
+	if err != nil {
+		t.Fatalf("Interpreter error: %v", err)
+	}
+	if compiled := runGo(t, source); interpreted != want || compiled != want {
+		t.Fatalf("Expected %q from both backends, got %q interpreted and %q compiled", want, interpreted, compiled)
+	}
+}
+
+func TestScopeAwareAssignment(t *testing.T) {
+	source := `total = 0
+for i in range(5):
+  total = total + i
+if total > 5:
+  label = "big"
+else:
+  label = "small"
+print label
+x = 1
+x = 2.5
+def report():
+  print total`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	expected := []string{
+		"var total int\n",
+		"total = 0",
+		"total = total + i",
+		"var label string\n\tif total > 5 {",
+		"label = \"big\"",
+		"var x float64 = 1",
+		"x = 2.5",
+	}
+	for _, want := range expected {
+		if !strings.Contains(goCode, want) {
+			t.Fatalf("Expected generated code to contain %q, got:\n%s", want, goCode)
+		}
+	}
+
+	for _, unwanted := range []string{"total :=", "label :=", "x :="} {
+		if strings.Contains(goCode, unwanted) {
+			t.Fatalf("Expected no redeclaration %q, got:\n%s", unwanted, goCode)
+		}
+	}
+}
+
+func TestTypeChecking(t *testing.T) {
+	source := `name = "bob"
+n = 5
+f = 2.5
+print name + n
+print n + f
+print "-" * n`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	expected := []string{
+		`fmt.Sprintf("%s%d", name, n)`,
+		"float64(n) + f",
+		"strings.Repeat(\"-\", n)",
+	}
+	for _, want := range expected {
+		if !strings.Contains(goCode, want) {
+			t.Fatalf("Expected generated code to contain %q, got:\n%s", want, goCode)
+		}
+	}
+
+	errorCases := map[string]string{
+		"x = 1\ny = \"a\" - x":                 "line 2, column 5: unsupported operand types for -: str and int",
+		"xs = [1]\nprint xs < 2":               "line 2, column 7: '<' is not supported between list[int] and int",
+		"def f(a):\n  return a\nprint f(1, 2)": "line 3, column 7: f() takes 1 argument, got 2",
+		"x = 5\nprint x[0]":                    "line 2, column 7: int is not subscriptable",
+		"def f():\n  return\nf()\nprint f()":   "line 4, column 7: function 'f' does not return a value",
+	}
+	for source, want := range errorCases {
+		program, err := parser.Parse(source)
+		if err != nil {
+			t.Fatalf("Parse error: %v", err)
+		}
+		_, err = transpiler.GenerateGoCode(program)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("Expected error %q for %q, got %v", want, source, err)
+		}
+	}
+}
+
+func TestUndefinedNames(t *testing.T) {
+	// The program is rejected before its first line runs
+	cases := map[string]string{
+		"print 1\nprint xs":                  "line 2, column 7: name 'xs' is not defined",
+		"print 1\ndef f():\n  return foo(1)": "line 3, column 10: name 'foo' is not defined",
+	}
+	for source, want := range cases {
+		program, err := parser.Parse(source)
+		if err != nil {
+			t.Fatalf("Parse error: %v", err)
+		}
+		_, err = transpiler.Check(program)
+		var diagnostics parser.Diagnostics
+		if !errors.As(err, &diagnostics) || len(diagnostics) != 1 ||
+			diagnostics[0].Code != parser.CodeUndefined || !strings.Contains(err.Error(), want) {
+			t.Fatalf("Expected error %q for %q, got %v", want, source, err)
+		}
+	}
+}
+
+func TestUnusedVariables(t *testing.T) {
+	source := `total = 0
+for item in [1, 2]:
+  total = 1
+def f(a):
+  tmp = a
+  return a
+f(1)`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	result, err := transpiler.Transpile(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	expected := []string{
+		"total := 0\n\t_ = total",
+		"for range []int{1, 2} {",
+		"tmp := a\n\t_ = tmp",
+	}
+	for _, want := range expected {
+		if !strings.Contains(result.Code, want) {
+			t.Fatalf("Expected generated code to contain %q, got:\n%s", want, result.Code)
+		}
+	}
+
+	// Nothing is printed, so nothing needs fmt
+	if strings.Contains(result.Code, "import") {
+		t.Fatalf("Expected no imports, got:\n%s", result.Code)
+	}
+
+	if len(result.Warnings) != 2 {
+		t.Fatalf("Expected 2 warnings, got %v", result.Warnings)
+	}
+	if result.Warnings[0].Span.From.Line != 1 || !strings.Contains(result.Warnings[0].Message, "'total' is assigned but never used") {
+		t.Fatalf("Unexpected warning: %+v", result.Warnings[0])
+	}
+	if result.Warnings[1].Span.From.Line != 5 || !strings.Contains(result.Warnings[1].Message, "'tmp' is assigned but never used") {
+		t.Fatalf("Unexpected warning: %+v", result.Warnings[1])
+	}
+}
+
+func TestSourcePositions(t *testing.T) {
+	source := "x = 1\nif x > 0:\n  print foo(x + 1)\n"
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	text := func(node interface {
+		Pos() parser.Position
+		End() parser.Position
+	}) string {
+		return source[node.Pos().Offset:node.End().Offset]
+	}
+
+	ifStmt := program.Statements[1].(*parser.IfStatement)
+	if ifStmt.Pos() != (parser.Position{Offset: 6, Line: 2, Column: 1}) {
+		t.Fatalf("Unexpected if statement position: %+v", ifStmt.Pos())
+	}
+	if text(ifStmt) != "if x > 0:\n  print foo(x + 1)" {
+		t.Fatalf("Unexpected if statement span: %q", text(ifStmt))
+	}
+
+	print := ifStmt.Branches[0].Body[0].(*parser.PrintStatement)
+	call := print.Arguments[0].(*parser.CallExpression)
+	if call.Pos().Line != 3 || call.Pos().Column != 9 {
+		t.Fatalf("Unexpected call position: %v", call.Pos())
+	}
+	if text(call) != "foo(x + 1)" || text(call.Arguments[0]) != "x + 1" {
+		t.Fatalf("Unexpected spans: %q, %q", text(call), text(call.Arguments[0]))
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	source := "x = 1\nif x > 0:\n\ty = \"a\" - x\n"
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	_, err = transpiler.Transpile(program)
+	var diagnostics parser.Diagnostics
+	if !errors.As(err, &diagnostics) || len(diagnostics) != 1 {
+		t.Fatalf("Expected one diagnostic, got %v", err)
+	}
+
+	rendered := diagnostics[0].Render("script.klo", source)
+	expected := "script.klo:3:6: error: unsupported operand types for -: str and int [type]\n" +
+		"    3 | \ty = \"a\" - x\n" +
+		"      | \t    ^~~~~~~\n"
+	if rendered != expected {
+		t.Fatalf("Expected rendered diagnostic:\n%s\ngot:\n%s", expected, rendered)
+	}
+
+	json := diagnostics[0].JSON("script.klo")
+	for _, want := range []string{
+		`"file":"script.klo"`,
+		`"severity":"error"`,
+		`"code":"type"`,
+		`"start":{"offset":21,"line":3,"column":6}`,
+	} {
+		if !strings.Contains(json, want) {
+			t.Fatalf("Expected JSON diagnostic to contain %s, got %s", want, json)
+		}
+	}
+
+	// Syntax errors name what was found rather than dumping the token
+	_, err = parser.Parse("while x > 0\n  print x\n")
+	if err == nil || !strings.Contains(err.Error(), "line 1, column 12: Expected ':' after while condition, got end of line") {
+		t.Fatalf("Expected syntax error, got %v", err)
+	}
+
+	// Hints are kept apart from the message
+	_, err = parser.Parse("print !x\n")
+	if !errors.As(err, &diagnostics) || len(diagnostics[0].Suggestions) != 1 {
+		t.Fatalf("Expected a diagnostic with a suggestion, got %v", err)
+	}
+}
+
+func TestErrorRecovery(t *testing.T) {
+	source := `x = 1
+if x > 0
+  print x
+y = 1 2
+for i in range(3):
+  print i
+  z = $
+while x < 3:
+  print x
+    print y
+print (x]
+if x:
+print "done"
+`
+
+	_, err := parser.Parse(source)
+	var diagnostics parser.Diagnostics
+	if !errors.As(err, &diagnostics) {
+		t.Fatalf("Expected diagnostics, got %v", err)
+	}
+
+	expected := []string{
+		"line 2, column 9: Expected ':' after if condition, got end of line",
+		"line 4, column 7: expected end of line after statement, got '2'",
+		"line 7, column 7: unexpected character '$'",
+		"line 10, column 5: unexpected indent",
+		"line 11, column 9: closing ']' does not match '('",
+		"line 13, column 1: expected an indented block, got 'print'",
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d:\n%v", len(expected), len(diagnostics), err)
+	}
+	for i, want := range expected {
+		if diagnostics[i].Error() != want {
+			t.Fatalf("Expected error %d to be %q, got %q", i, want, diagnostics[i].Error())
+		}
+	}
+
+	// An unclosed bracket is reported where it was opened
+	_, err = parser.Parse("print (1 +\nprint 2\n")
+	if err == nil || !strings.Contains(err.Error(), "line 1, column 7: '(' was never closed") {
+		t.Fatalf("Expected unclosed bracket error, got %v", err)
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	source := `d = {"b": 2, "a": 1}
+for k in d:
+  if k == "a":
+    print k
+  elif k == "b":
+    print d[k]`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	result, err := transpiler.TranspileFile(program, "script.klo")
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	expected := []string{
+		"//line script.klo:1\n\td := map[string]int{",
+		"//line script.klo:4\n\t\t\tfmt.Println(k)",
+		"//line script.klo:5\n\t\t} else if k == \"b\" {",
+	}
+	for _, want := range expected {
+		if !strings.Contains(result.Code, want) {
+			t.Fatalf("Expected generated code to contain %q, got:\n%s", want, result.Code)
+		}
+	}
+
+	// Helpers are support code, and map to no klo line
+	goLines := map[string]int{}
+	for i, line := range strings.Split(result.Code, "\n") {
+		goLines[strings.TrimSpace(line)] = i + 1
+	}
+	lookup := goLines[`panic(fmt.Sprintf("KeyError: %v", key))`]
+	print := goLines["fmt.Println(kloLookup(d, k))"]
+	if result.SourceMap.Line(print) != 6 || result.SourceMap.Line(lookup) != 0 {
+		t.Fatalf("Unexpected source map: line %d maps to %d, line %d maps to %d",
+			print, result.SourceMap.Line(print), lookup, result.SourceMap.Line(lookup))
+	}
+
+	stderr := fmt.Sprintf("\t/tmp/klo_temp_script.go:%d +0x1d\n\t/tmp/klo_temp_script.go:%d +0x4a\n", lookup, print)
+	rewritten := result.SourceMap.Rewrite(stderr, "klo_temp_script.go", "script.klo")
+	want := fmt.Sprintf("\t/tmp/klo_temp_script.go:%d +0x1d\n\tscript.klo:6 +0x4a\n", lookup)
+	if rewritten != want {
+		t.Fatalf("Expected rewritten output %q, got %q", want, rewritten)
+	}
+
+	// Without a file name there are no directives
+	result, err = transpiler.Transpile(program)
+	if err != nil || strings.Contains(result.Code, "//line") {
+		t.Fatalf("Expected no //line directives, got %v:\n%s", err, result.Code)
+	}
+
+	// A body on the line of its header maps to that line too
+	program, err = parser.Parse("x = 1\nif x > 0: print \"pos\"\nprint x")
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	result, err = transpiler.TranspileFile(program, "script.klo")
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+	goLines = map[string]int{}
+	for i, line := range strings.Split(result.Code, "\n") {
+		goLines[strings.TrimSpace(line)] = i + 1
+	}
+	for code, want := range map[string]int{`fmt.Println("pos")`: 2, "fmt.Println(x)": 3} {
+		if got := result.SourceMap.Line(goLines[code]); got != want {
+			t.Fatalf("Expected %s to map to line %d, got %d:\n%s", code, want, got, result.Code)
+		}
+	}
+}
+
+func TestStringLiterals(t *testing.T) {
+	source := `print "He said \"hi\"", 'it\'s'
+print "tab\tnew\nline \u00e9 \x41"
+print r"C:\new\dir"
+s = """first
+"second" line"""
+print s`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	print := program.Statements[0].(*parser.PrintStatement)
+	if value := print.Arguments[0].(*parser.StringLiteral).Value; value != `He said "hi"` {
+		t.Fatalf("Unexpected string value: %q", value)
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	expected := []string{
+		`fmt.Println("He said \"hi\"", "it's")`,
+		`fmt.Println("tab\tnew\nline é A")`,
+		`fmt.Println("C:\\new\\dir")`,
+		`s := "first\n\"second\" line"`,
+	}
+	for _, want := range expected {
+		if !strings.Contains(goCode, want) {
+			t.Fatalf("Expected generated code to contain %q, got:\n%s", want, goCode)
+		}
+	}
+
+	// The statement after a multi-line string is on the right line
+	if line := program.Statements[4].Pos().Line; line != 6 {
+		t.Fatalf("Expected statement after multi-line string at line 6, got %d", line)
+	}
+
+	errorCases := map[string]string{
+		`print "bad \q"`:    "line 1, column 12: unknown escape sequence \\q",
+		`print "\u12"`:      "line 1, column 8: \\u escape needs 4 hex digits",
+		"print \"open\n1\n": "line 1, column 7: unterminated string",
+	}
+	for source, want := range errorCases {
+		_, err := parser.Parse(source)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("Expected error %q for %q, got %v", want, source, err)
+		}
+	}
+}
+
+func TestFormattedStrings(t *testing.T) {
+	source := `total = 3
+pct = 0.25
+name = "bob"
+print f"Total: {total} items ({pct:.1f}%)"
+print f"{name:>6}|{total:05d}|{pct:.0%}|{{braces}}"
+print "n=" + total`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	str := program.Statements[3].(*parser.PrintStatement).Arguments[0].(*parser.InterpolatedString)
+	if len(str.Parts) != 5 || str.Parts[3].Spec != ".1f" {
+		t.Fatalf("Unexpected f-string parts: %v", str)
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	expected := []string{
+		`fmt.Println(fmt.Sprintf("Total: %d items (%.1f%%)", total, pct))`,
+		`fmt.Println(fmt.Sprintf("%6s|%05d|%.0f%%|{braces}", name, total, pct*100))`,
+		`fmt.Println(fmt.Sprintf("n=%d", total))`,
+	}
+	for _, want := range expected {
+		if !strings.Contains(goCode, want) {
+			t.Fatalf("Expected generated code to contain %q, got:\n%s", want, goCode)
+		}
+	}
+
+	errorCases := map[string]string{
+		`print f"{}"`:                         "line 1, column 10: empty expression in f-string",
+		`print f"{1"`:                         "line 1, column 9: replacement field in f-string is not closed",
+		`print f"a } b"`:                      "line 1, column 11: single '}' is not allowed in an f-string",
+		"name = \"bob\"\nprint f\"{name:d}\"": "line 2, column 9: format code 'd' needs an int, got str",
+		`print f"{1:^5}"`:                     "line 1, column 9: centered alignment with '^' is not supported",
+		`print f"{1.5:x}"`:                    "format code 'x' needs an int, got float",
+	}
+	for source, want := range errorCases {
+		program, err := parser.Parse(source)
+		if err == nil {
+			_, err = transpiler.GenerateGoCode(program)
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("Expected error %q for %q, got %v", want, source, err)
+		}
+	}
+}
+
+func TestNumberLiterals(t *testing.T) {
+	source := `print 0xFF, 0o17, 0b1010, 1_000_000, 1e3, .5, 42
+xs = [1e3]
+print xs`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	ints := map[int]int64{0: 255, 1: 15, 2: 10, 3: 1000000, 6: 42}
+	args := program.Statements[0].(*parser.PrintStatement).Arguments
+	for i, arg := range args {
+		number := arg.(*parser.NumberLiteral)
+		want, isInt := ints[i]
+		if number.IsFloat == isInt || isInt && number.Int != want {
+			t.Fatalf("Unexpected value for %s: %+v", number.Value, number)
+		}
+	}
+	if number := args[4].(*parser.NumberLiteral); number.Float != 1000 {
+		t.Fatalf("Expected 1e3 to be 1000, got %v", number.Float)
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+	if !strings.Contains(goCode, "xs := []float64{1e3}") {
+		t.Fatalf("Expected 1e3 to be a float, got:\n%s", goCode)
+	}
+
+	errorCases := map[string]string{
+		"x = 1.2.3":                "line 1, column 5: invalid number: a number has at most one decimal point",
+		"x = 0x":                   "invalid hexadecimal literal: no digits after 0x",
+		"x = 0b102":                "invalid digit '2' in binary literal",
+		"x = 012":                  "leading zeros are not allowed in decimal literals",
+		"x = 1__000":               "'_' must be between digits",
+		"x = 1e":                   "the exponent has no digits",
+		"x = 12abc":                "invalid decimal literal",
+		"x = 99999999999999999999": "integer literal is too large",
+	}
+	for source, want := range errorCases {
+		_, err := parser.Parse(source)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("Expected error %q for %q, got %v", want, source, err)
+		}
+	}
+}
+
+func TestUnicodeSource(t *testing.T) {
+	source := "\ufeffgröße = 5\n名前 = \"世界\"\nprint 名前, größe + 1"
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	assign := program.Statements[1].(*parser.AssignmentStatement)
+	if assign.Name != "名前" {
+		t.Fatalf("Expected identifier 名前, got %q", assign.Name)
+	}
+	// Columns count characters, not bytes
+	print := program.Statements[2].(*parser.PrintStatement)
+	if column := print.Arguments[1].Pos().Column; column != 11 {
+		t.Fatalf("Expected größe at column 11, got %d", column)
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+	if !strings.Contains(goCode, `fmt.Println(名前, größe+1)`) {
+		t.Fatalf("Expected Unicode identifiers in generated code, got:\n%s", goCode)
+	}
+
+	errorCases := map[string]string{
+		"x = \"é\" - €":      "line 1, column 11: unexpected character '€'",
+		"x = \"a\xffb\"":     "line 1, column 7: invalid UTF-8 encoding",
+		"x = 1\ny = 2\ufeff": "line 2, column 6: byte order mark (U+FEFF) in the middle of the file",
+		"x =\u00a01":         "line 1, column 4: unexpected invisible character U+00A0",
+	}
+	for source, want := range errorCases {
+		_, err := parser.Parse(source)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("Expected error %q for %q, got %v", want, source, err)
+		}
+	}
+}
+
+func TestNameMangling(t *testing.T) {
+	source := `type = 3
+fmt = "shadow"
+type_ = 4
+def main(chan):
+    return chan + type
+print type, fmt, type_, main(1)`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	expected := []string{
+		"//\ttype -> type__",
+		"//\tfmt -> fmt_",
+		"var type__ int",
+		`fmt_ := "shadow"`,
+		"type_ := 4",
+		"func main_(chan_ int) int {",
+		"return chan_ + type__",
+		"fmt.Println(type__, fmt_, type_, main_(1))",
+	}
+	for _, want := range expected {
+		if !strings.Contains(goCode, want) {
+			t.Fatalf("Expected generated code to contain %q, got:\n%s", want, goCode)
+		}
+	}
+}
+
+func TestBlankVariable(t *testing.T) {
+	// _ is a variable like any other, which Go's blank identifier is not
+	// when it is read
+	cases := []struct {
+		source, code, output string
+	}{
+		{"_ = 5\nprint _\nfor _ in [1]:\n  print _", "fmt.Println(_v)", "5\n1\n"},
+		{"_ = 5\n_ = \"a\"\nfor _ in [1, 2]:\n  print \"x\"", "\t_ = \"a\"\n", "x\nx\n"},
+	}
+	for _, c := range cases {
+		program, err := parser.Parse(c.source)
+		if err != nil {
+			t.Fatalf("Parse error: %v", err)
+		}
+		result, err := transpiler.Transpile(program)
+		if err != nil {
+			t.Fatalf("Transpile error: %v", err)
+		}
+		if !strings.Contains(result.Code, c.code) || len(result.Warnings) > 0 {
+			t.Fatalf("Expected generated code to contain %q without warnings, got %v:\n%s", c.code, result.Warnings, result.Code)
+		}
+
+		interpreted, err := interpret(c.source)
+		if err != nil {
+			t.Fatalf("Interpreter error for %q: %v", c.source, err)
+		}
+		if compiled := runGo(t, c.source); interpreted != c.output || compiled != c.output {
+			t.Fatalf("Expected %q from both backends for %q, got %q interpreted and %q compiled",
+				c.output, c.source, interpreted, compiled)
+		}
+	}
+}
+
+func TestGeneratedCodeIsFormatted(t *testing.T) {
+	source := `def twice(n): return n * 2
+
+def describe(n):
+  if n > 10 and not (n % 2 == 0):
+    return "big odd"
+  elif n > 10:
+    return "big"
+  else:
+    return "small"
+
+label = """steps
+summed"""
+total = 0
+for i in range(0, 20, 3):
+  total = total + (i - 1) * 2
+
+print describe(total), -(total + 1), twice(total), label`
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	for _, filename := range []string{"", "script.klo"} {
+		result, err := transpiler.TranspileFile(program, filename)
+		if err != nil {
+			t.Fatalf("Transpile error: %v", err)
+		}
+		formatted, err := format.Source([]byte(result.Code))
+		if err != nil {
+			t.Fatalf("Generated code does not parse: %v\n%s", err, result.Code)
+		}
+		if string(formatted) != result.Code {
+			t.Fatalf("Generated code is not gofmt-formatted:\n%s", result.Code)
+		}
+
+		expected := []string{
+			"func twice(n int) int {\n",
+			"n > 10 && !(n%2 == 0)",
+			"total = total + (i-1)*2",
+			"-(total + 1)",
+		}
+		for _, want := range expected {
+			if !strings.Contains(result.Code, want) {
+				t.Fatalf("Expected generated code to contain %q, got:\n%s", want, result.Code)
+			}
+		}
+		if strings.Contains(result.Code, "summed\"\n\n") {
+			t.Fatalf("Expected no blank line after a multi-line string, got:\n%s", result.Code)
+		}
+	}
+}
+
+func TestInterpreter(t *testing.T) {
+	source := `def fib(n):
+  if n < 2:
+    return n
+  return fib(n - 1) + fib(n - 2)
+
+scores = {"bob": 3, "alice": 5}
+scores["carol"] = 4
+for name, score in scores.items():
+  print name, score
+
+total = 0
+for i in range(10, 0, -3):
+  total = total + i
+average = total / 4
+average = average + 0.5
+
+items = [1, 2]
+items.append(fib(10))
+print items, len(items), total, average, 0.1 + 0.2, 7 / 2
+print f"{average:6.2f}|{'ab' * 2:>5}|", "done " + 3`
+
+	output, err := interpret(source)
+	if err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+
+	expected := `alice 5
+bob 3
+carol 4
+[1 2 55] 3 22 5.5 0.3 3
+  5.50| abab| done 3
+`
+	if output != expected {
+		t.Fatalf("Expected output:\n%s\ngot:\n%s", expected, output)
+	}
+}
+
+func TestInterpreterRuntimeError(t *testing.T) {
+	source := `def lookup(d, key):
+  return d[key]
+
+print "before"
+ages = {"bob": 3}
+print lookup(ages, "alice")`
+
+	output, err := interpret(source)
+	if output != "before\n" {
+		t.Fatalf("Expected output before the error, got %q", output)
+	}
+
+	var diagnostics parser.Diagnostics
+	if !errors.As(err, &diagnostics) || len(diagnostics) != 1 {
+		t.Fatalf("Expected a runtime diagnostic, got %v", err)
+	}
+	diagnostic := diagnostics[0]
+	if diagnostic.Code != parser.CodeRuntime || diagnostic.Span.From.Line != 2 {
+		t.Fatalf("Expected a runtime error on line 2, got %v", diagnostic)
+	}
+	if !strings.Contains(diagnostic.Message, "alice") {
+		t.Fatalf("Expected the missing key in the message, got %q", diagnostic.Message)
+	}
+	if len(diagnostic.Notes) != 1 || diagnostic.Notes[0] != "in lookup(), called at line 6" {
+		t.Fatalf("Expected a note on the call, got %v", diagnostic.Notes)
+	}
+}
+
+// interpret type checks and runs a program with the interpreter,
+// returning what it printed
+func TestBackendsAgreeOnLoopVariables(t *testing.T) {
+	sources := []string{
+		"i = 100\nfor i in range(3):\n  print i\nprint i",
+		"for i in range(10, 0, -3):\n  print i\nprint i",
+		"x = 0\nfor x in [5, 6]:\n  print x\nprint x",
+		"n = 7\nfor n in range(0):\n  print n\nprint n",
+		"n = 3\nfor i in range(n):\n  n = n + 1\n  i = 10\nprint i, n",
+		"for ch in \"hey\":\n  print ch\nprint ch",
+		"for i, c in enumerate(\"h\u00e9llo\"):\n  print i, c\nprint i, c",
+		"for i, c in enumerate(\"\u00e9t\u00e9\"):\n  print i, c",
+		"for i, x in enumerate([4, 5]):\n  print i\nprint i, x",
+		"for k, v in {\"a\": 1, \"b\": 2}.items():\n  print k\nprint k, v",
+		"for i, x in enumerate([1]):\n  print x\nfor i, x in enumerate([2]):\n  print x\nprint i",
+		"def last(a):\n  for a in range(a):\n    print a\n  return a\nprint last(3)",
+		// A variable used only by loops has a type of its own in each
+		"total = 0\nfor x in [1, 2, 3]:\n  total = total + x\nfor x in [\"a\", \"b\"]:\n  print x\nprint total",
+		"def f():\n  for v in [1.5]:\n    print v + 1\n  for v in [[1], [2, 3]]:\n    print len(v)\nf()",
+	}
+
+	for _, source := range sources {
+		want := runGo(t, source)
+		got, err := interpret(source)
+		if err != nil {
+			t.Fatalf("Run error for %q: %v", source, err)
+		}
+		if got != want {
+			t.Fatalf("Interpreter output for %q differs from Go:\n%s\nGo:\n%s", source, got, want)
+		}
+	}
+}
+
+func interpret(source string) (string, error) {
+	program, err := parser.Parse(source)
+	if err != nil {
+		return "", err
+	}
+	info, err := transpiler.Check(program)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	err = interp.New(&out).Run(program, info)
+	return out.String(), err
+}
+
+func TestRepl(t *testing.T) {
+	input := `def square(n):
+  return n * n
+
+x = 4
+square(x) + 1
+names = ["a",
+  "b"]
+for name in names:
+  print name
+
+:go
+x = x / 0
+x
+:reset
+x
+`
+
+	var out, errOut strings.Builder
+	repl := &repl{
+		in:     &scannerReader{scanner: bufio.NewScanner(strings.NewReader(input))},
+		out:    &out,
+		errOut: &errOut,
+	}
+	repl.run()
+
+	expected := `17
+a
+b
+for _, name := range names {
+	fmt.Println(name)
+}
+4
+`
+	if out.String() != expected {
+		t.Fatalf("Expected output:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	// Errors are reported at the lines of the input, and the variables
+	// of the session are kept until :reset
+	for _, want := range []string{
+		"repl:1:5: error: integer divide by zero [runtime]",
+		"repl:1:1: error: name 'x' is not defined [undefined]",
+	} {
+		if !strings.Contains(errOut.String(), want) {
+			t.Fatalf("Expected errors to contain %q, got:\n%s", want, errOut.String())
+		}
+	}
+	if len(repl.history) != 8 {
+		t.Fatalf("Expected 8 inputs in the history, got %q", repl.history)
+	}
+}
+
+func TestReplRedefinition(t *testing.T) {
+	input := `def f(n):
+  return n + 1
+
+def g(n):
+  return f(n) * 2
+
+g(1)
+def f(n):
+  return n * 10
+
+g(1)
+def f(n):
+  return "f" + n
+
+f(1)
+`
+
+	var out, errOut strings.Builder
+	repl := &repl{
+		in:     &scannerReader{scanner: bufio.NewScanner(strings.NewReader(input))},
+		out:    &out,
+		errOut: &errOut,
+	}
+	repl.run()
+
+	if want := "4\n20\nf1\n"; out.String() != want {
+		t.Fatalf("Expected output %q, got %q (errors: %s)", want, out.String(), errOut.String())
+	}
+}
+
+func TestReplRebinding(t *testing.T) {
+	// Each input is checked on its own, with the types the variables of
+	// earlier inputs hold
+	input := `x = 1
+y = x + 2
+x = "s"
+x + "t"
+y
+def twice(v):
+  return v + v
+
+twice(2)
+twice("ab")
+`
+
+	var out, errOut strings.Builder
+	repl := &repl{
+		in:     &scannerReader{scanner: bufio.NewScanner(strings.NewReader(input))},
+		out:    &out,
+		errOut: &errOut,
+	}
+	repl.run()
+
+	if want := "st\n3\n4\nabab\n"; out.String() != want || errOut.Len() > 0 {
+		t.Fatalf("Expected output %q, got %q (errors: %s)", want, out.String(), errOut.String())
+	}
+}
+
+func TestReplIncompleteInput(t *testing.T) {
+	tests := map[string]bool{
+		"x = 1":                 false,
+		"if x > 1:":             true,
+		"def f(n): return n":    false,
+		"def f(n):\n  return n": true,
+		"xs = [1,":              true,
+		"d = {\"a\": 1}":        false,
+		`s = """first`:          true,
+		`s = "first`:            false,
+	}
+	for input, want := range tests {
+		if got := incomplete(input); got != want {
+			t.Errorf("incomplete(%q) = %v, want %v", input, got, want)
+		}
+	}
+}
+
+func TestEmbedding(t *testing.T) {
+	type order struct {
+		Total   float64
+		Country string
+		Items   []string
+	}
+
+	vm := klo.New()
+	var out strings.Builder
+	vm.SetOutput(&out)
+
+	var logged []string
+	if err := vm.Set("order", order{Total: 120, Country: "nl", Items: []string{"book", "pen"}}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if err := vm.Set("rates", map[string]any{"nl": 21, "de": 19.5}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if err := vm.Register("log", func(message string) { logged = append(logged, message) }); err != nil {
+		t.Fatalf("Register error: %v", err)
+	}
+	if err := vm.Register("upper", strings.ToUpper); err != nil {
+		t.Fatalf("Register error: %v", err)
+	}
+
+	err := vm.Exec(`def tax(amount, country):
+  return amount * rates[country] / 100
+
+discount = 0
+if order["Total"] > 100:
+  discount = 10
+  log(f"discount for {len(order['Items'])} items")
+result = tax(order["Total"] - discount, order["Country"])
+print upper(order["Country"]), result`)
+	if err != nil {
+		t.Fatalf("Exec error: %v", err)
+	}
+
+	if discount := vm.Get("discount"); discount != 10 {
+		t.Fatalf("Expected discount 10, got %#v", discount)
+	}
+	if result := vm.Get("result"); result != 23.1 {
+		t.Fatalf("Expected result 23.1, got %#v", result)
+	}
+	if out.String() != "NL 23.1\n" {
+		t.Fatalf("Expected printed output, got %q", out.String())
+	}
+	if len(logged) != 1 || logged[0] != "discount for 2 items" {
+		t.Fatalf("Expected one log message, got %q", logged)
+	}
+
+	// Functions and variables are kept from one Exec to the next
+	if err := vm.Exec(`total = tax(100, "de") + discount`); err != nil {
+		t.Fatalf("Exec error: %v", err)
+	}
+	if total := vm.Get("total"); total != 29.5 {
+		t.Fatalf("Expected total 29.5, got %#v", total)
+	}
+
+	// Errors of Go functions and wrong arguments stop the code
+	if err := vm.Register("fail", func() (int, error) { return 0, errors.New("no stock") }); err != nil {
+		t.Fatalf("Register error: %v", err)
+	}
+	for source, want := range map[string]string{
+		"x = fail()":           "fail(): no stock",
+		"x = upper(3)":         "upper(): argument 1: cannot use int as string",
+		`x = order["Total"`:    "'[' was never closed",
+		"def log(m):\n  x = m": "function log is already registered by the Go program",
+	} {
+		err := vm.Exec(source)
+		var diagnostics parser.Diagnostics
+		if !errors.As(err, &diagnostics) || diagnostics[0].Message != want {
+			t.Errorf("Exec(%q) = %v, want %q", source, err, want)
+		}
+	}
+
+	// Builtins and defs cannot be replaced by Go functions
+	for _, name := range []string{"len", "tax"} {
+		if err := vm.Register(name, strings.ToUpper); err == nil {
+			t.Fatalf("Expected an error registering %s", name)
+		}
+	}
+
+	// A panic in a Go function is not a klo error
+	if err := vm.Register("crash", func() { panic("host bug") }); err != nil {
+		t.Fatalf("Register error: %v", err)
+	}
+	func() {
+		defer func() {
+			err, ok := recover().(error)
+			if !ok || !strings.Contains(err.Error(), "host bug") || !strings.Contains(err.Error(), "goroutine") {
+				t.Fatalf("Expected the panic to go on with its stack, got %v", err)
+			}
+		}()
+		vm.Exec("crash()")
+	}()
+
+	if err := vm.Set("not a name", 1); err == nil {
+		t.Fatalf("Expected an error for an invalid name")
+	}
+	if err := vm.Set("ch", make(chan int)); err == nil {
+		t.Fatalf("Expected an error for a value with no klo counterpart")
+	}
+}
+
+// runGo transpiles a program and runs the Go code with go run, returning
+// what it printed. The test is skipped when Go is not installed.
+func runGo(t *testing.T, source string) string {
+	t.Helper()
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is not installed")
+	}
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	goCode, err := transpiler.GenerateGoCode(program)
+	if err != nil {
+		t.Fatalf("Transpile error: %v", err)
+	}
+
+	goFile := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(goFile, []byte(goCode), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command(goTool, "run", goFile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run failed: %v\n%s\nGo code:\n%s", err, output, goCode)
+	}
+	return string(output)
 }
@@ -1,5 +1,11 @@
 package parser
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 // AST Node types
 type Node interface {
 	String() string
@@ -18,16 +24,48 @@ func (p *Program) String() string {
 type Statement interface {
 	Node
 	statementNode()
+	Pos() Position
+	End() Position
+	setSpan(Span)
 }
 
 // Expression interface
 type Expression interface {
 	Node
 	expressionNode()
+	Pos() Position
+	End() Position
+	setSpan(Span)
+}
+
+// Position is a place in the source code
+type Position struct {
+	Offset int `json:"offset"` // byte offset, starting at 0
+	Line   int `json:"line"`   // line number, starting at 1
+	Column int `json:"column"` // column in characters, starting at 1
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
 }
 
+// Span is the range of source code a node was parsed from
+type Span struct {
+	From Position `json:"start"` // first character
+	To   Position `json:"end"`   // just past the last character
+}
+
+// Pos returns the position of the first character of the node
+func (s Span) Pos() Position { return s.From }
+
+// End returns the position just past the last character of the node
+func (s Span) End() Position { return s.To }
+
+func (s *Span) setSpan(span Span) { *s = span }
+
 // PrintStatement represents a print statement
 type PrintStatement struct {
+	Span
 	Arguments []Expression
 }
 
@@ -36,6 +74,7 @@ func (ps *PrintStatement) String() string { return "PrintStatement" }
 
 // AssignmentStatement represents variable assignment
 type AssignmentStatement struct {
+	Span
 	Name  string
 	Value Expression
 }
@@ -43,11 +82,39 @@ type AssignmentStatement struct {
 func (as *AssignmentStatement) statementNode() {}
 func (as *AssignmentStatement) String() string { return "AssignmentStatement" }
 
-// IfStatement represents conditional statement
+// IndexAssignmentStatement represents assignment to an element, as in xs[i] = v
+type IndexAssignmentStatement struct {
+	Span
+	Target *IndexExpression
+	Value  Expression
+}
+
+func (ias *IndexAssignmentStatement) statementNode() {}
+func (ias *IndexAssignmentStatement) String() string { return "IndexAssignmentStatement" }
+
+// DeleteStatement removes an element, as in del d[k]
+type DeleteStatement struct {
+	Span
+	Target *IndexExpression
+}
+
+func (ds *DeleteStatement) statementNode() {}
+func (ds *DeleteStatement) String() string { return "DeleteStatement" }
+
+// IfStatement represents conditional statement. The first branch is the
+// if clause and every following branch is an elif clause.
 type IfStatement struct {
+	Span
+	Branches []IfBranch
+	Else     []Statement
+	ElsePos  Position // position of the else keyword, if there is one
+}
+
+// IfBranch is a condition and the body that runs when it holds
+type IfBranch struct {
+	Span
 	Condition Expression
 	Body      []Statement
-	Else      []Statement
 }
 
 func (is *IfStatement) statementNode() {}
@@ -55,24 +122,77 @@ func (is *IfStatement) String() string { return "IfStatement" }
 
 // ForStatement represents for loop statement
 type ForStatement struct {
-	Variable string      // loop variable (e.g., "i")
-	Iterable Expression  // what to iterate over (e.g., range(5))
-	Body     []Statement // loop body
+	Span
+	Variable      string      // loop variable (e.g., "i")
+	ValueVariable string      // second loop variable in "for k, v in ...", or ""
+	Iterable      Expression  // what to iterate over (e.g., range(5))
+	Body          []Statement // loop body
 }
 
 func (fs *ForStatement) statementNode() {}
 func (fs *ForStatement) String() string { return "ForStatement" }
 
-// RangeExpression represents range(n) function
+// WhileStatement represents a while loop
+type WhileStatement struct {
+	Span
+	Condition Expression
+	Body      []Statement
+}
+
+func (ws *WhileStatement) statementNode() {}
+func (ws *WhileStatement) String() string { return "WhileStatement" }
+
+// BreakStatement exits the innermost loop
+type BreakStatement struct {
+	Span
+}
+
+func (bs *BreakStatement) statementNode() {}
+func (bs *BreakStatement) String() string { return "BreakStatement" }
+
+// ContinueStatement skips to the next iteration of the innermost loop
+type ContinueStatement struct {
+	Span
+}
+
+func (cs *ContinueStatement) statementNode() {}
+func (cs *ContinueStatement) String() string { return "ContinueStatement" }
+
+// FunctionDefinition represents a def block
+type FunctionDefinition struct {
+	Span
+	Name       string      // function name
+	Parameters []string    // parameter names in declaration order
+	Body       []Statement // function body
+}
+
+func (fd *FunctionDefinition) statementNode() {}
+func (fd *FunctionDefinition) String() string { return "FunctionDefinition" }
+
+// ReturnStatement represents a return from a function
+type ReturnStatement struct {
+	Span
+	Value Expression // nil for a bare return
+}
+
+func (rs *ReturnStatement) statementNode() {}
+func (rs *ReturnStatement) String() string { return "ReturnStatement" }
+
+// RangeExpression represents range(stop), range(start, stop) and
+// range(start, stop, step)
 type RangeExpression struct {
-	End Expression // end value
+	Span
+	Start Expression // first value, nil for 0
+	Stop  Expression // exclusive bound
+	Step  Expression // increment (may be negative), nil for 1
 }
 
 func (re *RangeExpression) expressionNode() {}
-func (re *RangeExpression) String() string { return "range(...)" }
+func (re *RangeExpression) String() string  { return "range(...)" }
 
 // ExpressionStatement wraps expressions used as statements
 type ExpressionStatement struct {
+	Span
 	Expression Expression
 }
 
@@ -81,30 +201,178 @@ func (es *ExpressionStatement) String() string { return "ExpressionStatement" }
 
 // Identifier represents variable names
 type Identifier struct {
+	Span
 	Value string
 }
 
 func (i *Identifier) expressionNode() {}
-func (i *Identifier) String() string { return i.Value }
+func (i *Identifier) String() string  { return i.Value }
 
 // StringLiteral represents string values
 type StringLiteral struct {
+	Span
 	Value string
 }
 
 func (sl *StringLiteral) expressionNode() {}
-func (sl *StringLiteral) String() string { return "\"" + sl.Value + "\"" }
+func (sl *StringLiteral) String() string  { return strconv.Quote(sl.Value) }
 
-// NumberLiteral represents numeric values
+// InterpolatedString represents an f-string, as in f"Total: {total:.2f}":
+// literal text and the values of expressions, each with an optional
+// format spec
+type InterpolatedString struct {
+	Span
+	Parts []InterpolationPart
+}
+
+// InterpolationPart is literal text when Value is nil, and a replacement
+// field otherwise. The span of a replacement field includes its braces.
+type InterpolationPart struct {
+	Span
+	Text  string
+	Value Expression
+	Spec  string // format spec after ':', as in "{pct:.1f}"
+}
+
+func (is *InterpolatedString) expressionNode() {}
+func (is *InterpolatedString) String() string {
+	var out strings.Builder
+	for _, part := range is.Parts {
+		switch {
+		case part.Value == nil:
+			out.WriteString(strings.NewReplacer("{", "{{", "}", "}}").Replace(part.Text))
+		case part.Spec != "":
+			out.WriteString("{" + part.Value.String() + ":" + part.Spec + "}")
+		default:
+			out.WriteString("{" + part.Value.String() + "}")
+		}
+	}
+	return "f" + strconv.Quote(out.String())
+}
+
+// NumberLiteral represents numeric values. Value is the literal as it is
+// written, and Int or Float its value, depending on IsFloat.
 type NumberLiteral struct {
-	Value string
+	Span
+	Value   string
+	IsFloat bool
+	Int     int64
+	Float   float64
+}
+
+// NewNumberLiteral returns the literal for the text of a NUMBER token.
+// Literals with a decimal point or an exponent are floats.
+func NewNumberLiteral(text string) *NumberLiteral {
+	literal := &NumberLiteral{Value: text}
+	if n, err := strconv.ParseInt(text, 0, 64); err == nil {
+		literal.Int = n
+		return literal
+	}
+	literal.IsFloat = true
+	literal.Float, _ = strconv.ParseFloat(text, 64)
+	return literal
 }
 
 func (nl *NumberLiteral) expressionNode() {}
-func (nl *NumberLiteral) String() string { return nl.Value }
+func (nl *NumberLiteral) String() string  { return nl.Value }
+
+// CallExpression represents a function call
+type CallExpression struct {
+	Span
+	Function  Expression // the called function (e.g., an Identifier)
+	Arguments []Expression
+}
+
+func (ce *CallExpression) expressionNode() {}
+func (ce *CallExpression) String() string  { return ce.Function.String() + "(...)" }
+
+// MemberExpression represents attribute access, as in xs.append
+type MemberExpression struct {
+	Span
+	Object Expression
+	Name   string
+}
+
+func (me *MemberExpression) expressionNode() {}
+func (me *MemberExpression) String() string  { return me.Object.String() + "." + me.Name }
+
+// ListLiteral represents a list such as [1, 2, 3]
+type ListLiteral struct {
+	Span
+	Elements []Expression
+}
+
+func (ll *ListLiteral) expressionNode() {}
+func (ll *ListLiteral) String() string  { return "[...]" }
+
+// DictLiteral represents a dictionary such as {"a": 1}
+type DictLiteral struct {
+	Span
+	Entries []DictEntry // entries in source order
+}
+
+// DictEntry is a single key: value pair of a DictLiteral
+type DictEntry struct {
+	Key   Expression
+	Value Expression
+}
+
+func (dl *DictLiteral) expressionNode() {}
+func (dl *DictLiteral) String() string  { return "{...}" }
+
+// IndexExpression represents element access, as in xs[i]
+type IndexExpression struct {
+	Span
+	Object Expression
+	Index  Expression
+}
+
+func (ie *IndexExpression) expressionNode() {}
+func (ie *IndexExpression) String() string {
+	return ie.Object.String() + "[" + ie.Index.String() + "]"
+}
+
+// BooleanLiteral represents True or False
+type BooleanLiteral struct {
+	Span
+	Value bool
+}
+
+func (bl *BooleanLiteral) expressionNode() {}
+func (bl *BooleanLiteral) String() string {
+	if bl.Value {
+		return "True"
+	}
+	return "False"
+}
+
+// NoneLiteral represents None
+type NoneLiteral struct {
+	Span
+}
+
+func (nl *NoneLiteral) expressionNode() {}
+func (nl *NoneLiteral) String() string  { return "None" }
+
+// UnaryExpression represents a prefix operation: -x, +x or not x
+type UnaryExpression struct {
+	Span
+	Operator string
+	Operand  Expression
+}
+
+func (ue *UnaryExpression) expressionNode() {}
+func (ue *UnaryExpression) String() string {
+	if ue.Operator == "not" {
+		return "(not " + ue.Operand.String() + ")"
+	}
+	return "(" + ue.Operator + ue.Operand.String() + ")"
+}
 
-// BinaryExpression represents binary operations
+// BinaryExpression represents binary operations. The logical operators
+// "and" and "or" short-circuit.
 type BinaryExpression struct {
+	Span
 	Left     Expression
 	Operator string
 	Right    Expression
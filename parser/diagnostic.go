@@ -0,0 +1,172 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Severity tells whether a diagnostic stops the program from running
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+)
+
+func (s Severity) String() string {
+	if s == Warning {
+		return "warning"
+	}
+	return "error"
+}
+
+// MarshalText makes severities appear by name in JSON output
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Diagnostic codes, grouped by the kind of problem
+const (
+	CodeSyntax         = "syntax"              // malformed source
+	CodeIndentation    = "indentation"         // inconsistent or unexpected indentation
+	CodeMisplaced      = "misplaced-statement" // a statement that is not allowed where it appears
+	CodeType           = "type"                // an operation on values of the wrong type
+	CodeRedefined      = "redefined"           // a function defined more than once
+	CodeUndefined      = "undefined"           // a name that is neither a variable nor a function
+	CodeUnsupported    = "unsupported"         // valid klo that cannot be transpiled
+	CodeUnusedVariable = "unused-variable"     // a variable that is assigned but never read
+	CodeUnusedValue    = "unused-value"        // an expression statement whose value is discarded
+	CodeRuntime        = "runtime"             // a failure while the program runs, such as a missing key
+)
+
+// Diagnostic is a problem found in a klo program, located by the span of
+// source code it concerns
+type Diagnostic struct {
+	Severity    Severity `json:"severity"`
+	Code        string   `json:"code"`
+	Span        Span     `json:"span"`
+	Message     string   `json:"message"`
+	Notes       []string `json:"notes,omitempty"`       // further explanation
+	Suggestions []string `json:"suggestions,omitempty"` // ways to fix the problem
+}
+
+// Errorf returns an error diagnostic for the given span
+func Errorf(span Span, code, format string, args ...any) Diagnostic {
+	return Diagnostic{
+		Severity: Error,
+		Code:     code,
+		Span:     span,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// Warningf returns a warning diagnostic for the given span
+func Warningf(span Span, code, format string, args ...any) Diagnostic {
+	d := Errorf(span, code, format, args...)
+	d.Severity = Warning
+	return d
+}
+
+// SpanOf returns the span of a statement or expression
+func SpanOf(node interface {
+	Pos() Position
+	End() Position
+}) Span {
+	return Span{From: node.Pos(), To: node.End()}
+}
+
+// WithSuggestion returns the diagnostic with a suggested fix added
+func (d Diagnostic) WithSuggestion(format string, args ...any) Diagnostic {
+	d.Suggestions = append(slices.Clip(d.Suggestions), fmt.Sprintf(format, args...))
+	return d
+}
+
+// WithNote returns the diagnostic with a note added
+func (d Diagnostic) WithNote(format string, args ...any) Diagnostic {
+	d.Notes = append(slices.Clip(d.Notes), fmt.Sprintf(format, args...))
+	return d
+}
+
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", d.Span.From.Line, d.Span.From.Column, d.Message)
+}
+
+// Render formats the diagnostic for a terminal: the location and message,
+// the offending source line with the span underlined, then any notes and
+// suggestions.
+//
+//	script.klo:2:5: error: unsupported operand types for -: str and int [type]
+//	    2 | y = "a" - x
+//	      |     ^~~~~~~
+func (d Diagnostic) Render(filename, source string) string {
+	var out strings.Builder
+	from := d.Span.From
+	fmt.Fprintf(&out, "%s:%d:%d: %s: %s [%s]\n", filename, from.Line, from.Column, d.Severity, d.Message, d.Code)
+
+	if from.Line > 0 && from.Offset <= len(source) {
+		lineStart := strings.LastIndexByte(source[:from.Offset], '\n') + 1
+		lineEnd := len(source)
+		if i := strings.IndexAny(source[from.Offset:], "\r\n"); i >= 0 {
+			lineEnd = from.Offset + i
+		}
+
+		// The underline stops at the end of the first line of the span
+		to := min(max(d.Span.To.Offset, from.Offset), lineEnd)
+		width := max(utf8.RuneCountInString(source[from.Offset:to]), 1)
+
+		// Tabs are kept so the underline lines up with the source, and a
+		// byte order mark, which takes no space, is skipped
+		var padding strings.Builder
+		for _, r := range source[lineStart:from.Offset] {
+			switch r {
+			case '\t':
+				padding.WriteRune('\t')
+			case '\uFEFF':
+			default:
+				padding.WriteRune(' ')
+			}
+		}
+
+		gutter := strings.Repeat(" ", len(fmt.Sprint(from.Line)))
+		fmt.Fprintf(&out, "    %d | %s\n", from.Line, source[lineStart:lineEnd])
+		fmt.Fprintf(&out, "    %s | %s^%s\n", gutter, padding.String(), strings.Repeat("~", width-1))
+	}
+
+	for _, note := range d.Notes {
+		fmt.Fprintf(&out, "    = note: %s\n", note)
+	}
+	for _, suggestion := range d.Suggestions {
+		fmt.Fprintf(&out, "    = help: %s\n", suggestion)
+	}
+
+	return out.String()
+}
+
+// JSON formats the diagnostic as a single line of JSON, for editors and
+// CI systems
+func (d Diagnostic) JSON(filename string) string {
+	data, err := json.Marshal(struct {
+		File string `json:"file"`
+		Diagnostic
+	}{filename, d})
+	if err != nil {
+		// Diagnostics only hold strings and numbers
+		panic(err)
+	}
+	return string(data)
+}
+
+// Diagnostics is a list of problems. It is the error returned by Parse
+// and by the transpiler.
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	messages := make([]string, len(d))
+	for i, diagnostic := range d {
+		messages[i] = diagnostic.Error()
+	}
+	return strings.Join(messages, "\n")
+}
@@ -1,15 +1,46 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
-// Token represents a single token in the klo language
+// Token represents a single token in the klo language. Line, Column and
+// Offset locate its first character.
 type Token struct {
-	Type    TokenType
-	Value   string
-	Line    int
-	Column  int
+	Type   TokenType
+	Value  string
+	Line   int
+	Column int
+	Offset int      // byte offset in the source
+	End    Position // just past the last character
+}
+
+// Pos returns the position of the first character of the token
+func (t Token) Pos() Position {
+	return Position{Offset: t.Offset, Line: t.Line, Column: t.Column}
+}
+
+// describe names the token for error messages
+func (t Token) describe() string {
+	switch t.Type {
+	case NEWLINE:
+		return "end of line"
+	case EOF:
+		return "end of file"
+	case INDENT:
+		return "indentation"
+	case DEDENT:
+		return "end of block"
+	case STRING:
+		return fmt.Sprintf("string %q", t.Value)
+	}
+	return fmt.Sprintf("'%s'", t.Value)
 }
 
 // TokenType represents the type of token
@@ -21,30 +52,48 @@ const (
 	NEWLINE
 	INDENT
 	DEDENT
-	
+
 	// Literals
 	IDENTIFIER
 	STRING
 	NUMBER
-	
+
+	// f-strings: FSTRING_START, then FSTRING_TEXT for literal text and
+	// LBRACE, the expression tokens, an optional FSTRING_SPEC and RBRACE
+	// for each replacement field, then FSTRING_END
+	FSTRING_START
+	FSTRING_TEXT
+	FSTRING_SPEC
+	FSTRING_END
+
 	// Keywords
 	PRINT
 	IF
+	ELIF
 	ELSE
 	DEF
 	FOR
 	IN
 	WHILE
 	RETURN
-	
+	BREAK
+	CONTINUE
+	DEL
+	AND
+	OR
+	NOT
+	TRUE
+	FALSE
+	NONE
+
 	// Operators
-	ASSIGN     // =
-	PLUS       // +
-	MINUS      // -
-	MULTIPLY   // *
-	DIVIDE     // /
-	MODULO     // %
-	
+	ASSIGN   // =
+	PLUS     // +
+	MINUS    // -
+	MULTIPLY // *
+	DIVIDE   // /
+	MODULO   // %
+
 	// Comparison
 	EQUAL      // ==
 	NOT_EQUAL  // !=
@@ -52,216 +101,444 @@ const (
 	LESS_EQ    // <=
 	GREATER    // >
 	GREATER_EQ // >=
-	
+
 	// Punctuation
-	LPAREN     // (
-	RPAREN     // )
-	LBRACKET   // [
-	RBRACKET   // ]
-	COMMA      // ,
-	COLON      // :
-	DOT        // .
+	LPAREN   // (
+	RPAREN   // )
+	LBRACKET // [
+	RBRACKET // ]
+	LBRACE   // {
+	RBRACE   // }
+	COMMA    // ,
+	COLON    // :
+	DOT      // .
 )
 
 // Lexer tokenizes klo source code
 type Lexer struct {
-	input    string
-	position int
-	line     int
-	column   int
-	tokens   []Token
+	input       string
+	position    int
+	line        int
+	column      int
+	start       Position // start of the token being scanned
+	tokens      []Token
+	indents     []int // indentation widths of the open blocks
+	atLineStart bool
+	brackets    []Token // open parentheses, brackets and braces
+	errors      Diagnostics
 }
 
 // NewLexer creates a new lexer instance
 func NewLexer(input string) *Lexer {
 	return &Lexer{
-		input:  input,
-		line:   1,
-		column: 1,
+		input:       input,
+		line:        1,
+		column:      1,
+		indents:     []int{0},
+		atLineStart: true,
 	}
 }
 
-// Tokenize converts the input string into tokens
+// Tokenize converts the input string into tokens. Scanning goes on past
+// errors, so the tokens are returned along with Diagnostics for every
+// error found.
 func (l *Lexer) Tokenize() ([]Token, error) {
+	// A byte order mark at the start of the file is ignored, as by Go
+	if strings.HasPrefix(l.input, byteOrderMark) {
+		l.position = len(byteOrderMark)
+	}
+
 	for l.position < len(l.input) {
-		if err := l.scanToken(); err != nil {
-			return nil, err
+		start := l.position
+		var err error
+		if l.atLineStart {
+			err = l.scanIndentation()
+		} else {
+			err = l.scanToken()
 		}
+		if err != nil {
+			l.report(err)
+			if l.position == start {
+				l.advance() // skip the offending character
+			}
+		}
+	}
+
+	// A bracket left open joins every later line to its own, so it is
+	// reported where it was opened
+	if len(l.brackets) > 0 {
+		open := l.brackets[0]
+		l.report(errorAt(open, CodeSyntax, "'%s' was never closed", open.Value))
 	}
-	
+
+	// Terminate the last logical line and close any open blocks
+	l.start = l.pos()
+	if len(l.tokens) > 0 && l.tokens[len(l.tokens)-1].Type != NEWLINE {
+		l.addToken(NEWLINE, "\n")
+	}
+	for len(l.indents) > 1 {
+		l.indents = l.indents[:len(l.indents)-1]
+		l.addToken(DEDENT, "")
+	}
+
 	l.addToken(EOF, "")
+	if len(l.errors) > 0 {
+		return l.tokens, l.errors
+	}
 	return l.tokens, nil
 }
 
+// report records a scanning error. As in the parser, only the first
+// error of each line is kept.
+func (l *Lexer) report(err error) {
+	var diagnostic Diagnostic
+	if !errors.As(err, &diagnostic) {
+		diagnostic = l.errorf(CodeSyntax, "%v", err)
+	}
+	for _, reported := range l.errors {
+		if reported.Span.From.Line == diagnostic.Span.From.Line {
+			return
+		}
+	}
+	l.errors = append(l.errors, diagnostic)
+}
+
+// scanIndentation measures the leading whitespace of a line and emits
+// INDENT or DEDENT tokens when it differs from the enclosing block.
+// Blank and comment-only lines are skipped entirely.
+func (l *Lexer) scanIndentation() error {
+	width := 0
+	hasSpace, hasTab := false, false
+	for l.position < len(l.input) && (l.currentChar() == ' ' || l.currentChar() == '\t') {
+		if l.currentChar() == ' ' {
+			hasSpace = true
+		} else {
+			hasTab = true
+		}
+		width++
+		l.advance()
+	}
+
+	ch := l.currentChar()
+	if ch == '\n' || ch == '\r' || ch == '#' || l.position >= len(l.input) {
+		l.skipComment()
+		l.skipNewline()
+		return nil
+	}
+
+	if hasSpace && hasTab {
+		indentation := Span{From: Position{Offset: l.position - width, Line: l.line, Column: 1}, To: l.pos()}
+		l.report(Errorf(indentation, CodeIndentation, "mixed tabs and spaces in indentation").
+			WithSuggestion("indent with either spaces or tabs, not both"))
+	}
+
+	l.atLineStart = false
+	l.start = l.pos()
+	current := l.indents[len(l.indents)-1]
+
+	if width > current {
+		l.indents = append(l.indents, width)
+		l.addToken(INDENT, "")
+		return nil
+	}
+
+	for width < l.indents[len(l.indents)-1] {
+		l.indents = l.indents[:len(l.indents)-1]
+		l.addToken(DEDENT, "")
+	}
+
+	if width != l.indents[len(l.indents)-1] {
+		return l.errorf(CodeIndentation, "inconsistent dedent: indentation does not match any outer block")
+	}
+
+	return nil
+}
+
 func (l *Lexer) scanToken() error {
+	l.start = l.pos()
 	ch := l.currentChar()
-	
+
 	switch {
 	case ch == '\n' || ch == '\r':
-		// Handle both Unix (\n) and Windows (\r\n) line endings
-		if ch == '\r' && l.peekChar() == '\n' {
-			// Windows line ending, skip \r and \n
-			l.advance()
-			l.advance()
-		} else {
-			// Unix line ending, just skip \n
-			l.advance()
+		// Newlines inside parentheses, brackets or braces do not end the line
+		if len(l.brackets) == 0 {
+			l.addToken(NEWLINE, "\n")
+			l.atLineStart = true
 		}
-		l.addToken(NEWLINE, "\n")
-		l.line++
-		l.column = 1
+		l.skipNewline()
 		return nil
-		
+
 	case ch == ' ' || ch == '\t':
 		l.skipWhitespace()
 		return nil
-		
+
 	case ch == '#':
 		l.skipComment()
 		return nil
-		
+
 	case ch == '"' || ch == '\'':
-		return l.scanString()
-		
-	case isDigit(ch):
+		return l.scanString(false, false)
+
+	case l.stringPrefix() != "":
+		prefix := strings.ToLower(l.stringPrefix())
+		l.advanceBy(len(prefix))
+		return l.scanString(strings.Contains(prefix, "r"), strings.Contains(prefix, "f"))
+
+	case isDigit(ch) || ch == '.' && isDigit(l.peekChar()):
 		return l.scanNumber()
-		
+
 	case isAlpha(ch):
 		return l.scanIdentifier()
-		
+
 	case ch == '=':
 		if l.peekChar() == '=' {
-			l.addToken(EQUAL, "==")
 			l.advance()
 			l.advance()
+			l.addToken(EQUAL, "==")
 		} else {
-			l.addToken(ASSIGN, "=")
 			l.advance()
+			l.addToken(ASSIGN, "=")
 		}
 		return nil
-		
+
 	case ch == '!':
 		if l.peekChar() == '=' {
-			l.addToken(NOT_EQUAL, "!=")
 			l.advance()
 			l.advance()
+			l.addToken(NOT_EQUAL, "!=")
 		} else {
-			return fmt.Errorf("unexpected character '!' at line %d, column %d", l.line, l.column)
+			return l.errorf(CodeSyntax, "unexpected character '!'").
+				WithSuggestion("use 'not' to negate a condition")
 		}
 		return nil
-		
+
 	case ch == '<':
 		if l.peekChar() == '=' {
-			l.addToken(LESS_EQ, "<=")
 			l.advance()
 			l.advance()
+			l.addToken(LESS_EQ, "<=")
 		} else {
-			l.addToken(LESS, "<")
 			l.advance()
+			l.addToken(LESS, "<")
 		}
 		return nil
-		
+
 	case ch == '>':
 		if l.peekChar() == '=' {
-			l.addToken(GREATER_EQ, ">=")
 			l.advance()
 			l.advance()
+			l.addToken(GREATER_EQ, ">=")
 		} else {
-			l.addToken(GREATER, ">")
 			l.advance()
+			l.addToken(GREATER, ">")
 		}
 		return nil
-		
+
 	case ch == '+':
-		l.addToken(PLUS, "+")
 		l.advance()
+		l.addToken(PLUS, "+")
 		return nil
-		
+
 	case ch == '-':
-		l.addToken(MINUS, "-")
 		l.advance()
+		l.addToken(MINUS, "-")
 		return nil
-		
+
 	case ch == '*':
-		l.addToken(MULTIPLY, "*")
 		l.advance()
+		l.addToken(MULTIPLY, "*")
 		return nil
-		
+
 	case ch == '/':
-		l.addToken(DIVIDE, "/")
 		l.advance()
+		l.addToken(DIVIDE, "/")
 		return nil
-		
+
 	case ch == '%':
-		l.addToken(MODULO, "%")
 		l.advance()
+		l.addToken(MODULO, "%")
 		return nil
-		
+
 	case ch == '(':
-		l.addToken(LPAREN, "(")
 		l.advance()
+		l.addToken(LPAREN, "(")
+		l.brackets = append(l.brackets, l.tokens[len(l.tokens)-1])
 		return nil
-		
+
 	case ch == ')':
-		l.addToken(RPAREN, ")")
 		l.advance()
-		return nil
-		
+		l.addToken(RPAREN, ")")
+		return l.closeBracket(LPAREN)
+
 	case ch == '[':
-		l.addToken(LBRACKET, "[")
 		l.advance()
+		l.addToken(LBRACKET, "[")
+		l.brackets = append(l.brackets, l.tokens[len(l.tokens)-1])
 		return nil
-		
+
 	case ch == ']':
+		l.advance()
 		l.addToken(RBRACKET, "]")
+		return l.closeBracket(LBRACKET)
+
+	case ch == '{':
 		l.advance()
+		l.addToken(LBRACE, "{")
+		l.brackets = append(l.brackets, l.tokens[len(l.tokens)-1])
 		return nil
-		
+
+	case ch == '}':
+		l.advance()
+		l.addToken(RBRACE, "}")
+		return l.closeBracket(LBRACE)
+
 	case ch == ',':
-		l.addToken(COMMA, ",")
 		l.advance()
+		l.addToken(COMMA, ",")
 		return nil
-		
+
 	case ch == ':':
-		l.addToken(COLON, ":")
 		l.advance()
+		l.addToken(COLON, ":")
 		return nil
-		
+
 	case ch == '.':
-		l.addToken(DOT, ".")
 		l.advance()
+		l.addToken(DOT, ".")
 		return nil
-		
+
 	default:
-		return fmt.Errorf("unexpected character '%c' at line %d, column %d", ch, l.line, l.column)
+		if err, bad := l.encodingError(); bad {
+			return err
+		}
+		if unicode.IsSpace(ch) {
+			return l.errorf(CodeSyntax, "unexpected invisible character %U", ch).
+				WithSuggestion("replace it with a regular space")
+		}
+		if !unicode.IsPrint(ch) {
+			return l.errorf(CodeSyntax, "unexpected invisible character %U", ch)
+		}
+		return l.errorf(CodeSyntax, "unexpected character '%c'", ch)
 	}
 }
 
-func (l *Lexer) currentChar() byte {
-	if l.position >= len(l.input) {
+// byteOrderMark is the encoding of U+FEFF, which some editors write at
+// the start of UTF-8 files
+const byteOrderMark = "\uFEFF"
+
+// currentChar returns the character at the current position, or 0 at the
+// end of the input. A byte that is not valid UTF-8 is utf8.RuneError.
+func (l *Lexer) currentChar() rune {
+	r, _ := utf8.DecodeRuneInString(l.input[l.position:])
+	if r == utf8.RuneError && l.position >= len(l.input) {
 		return 0
 	}
-	return l.input[l.position]
+	return r
 }
 
-func (l *Lexer) peekChar() byte {
-	if l.position+1 >= len(l.input) {
+// peekChar returns the character after the current one
+func (l *Lexer) peekChar() rune {
+	if l.position >= len(l.input) {
 		return 0
 	}
-	return l.input[l.position+1]
+	_, size := utf8.DecodeRuneInString(l.input[l.position:])
+	r, _ := utf8.DecodeRuneInString(l.input[l.position+size:])
+	if r == utf8.RuneError && l.position+size >= len(l.input) {
+		return 0
+	}
+	return r
+}
+
+// charSize returns the length in bytes of the current character
+func (l *Lexer) charSize() int {
+	_, size := utf8.DecodeRuneInString(l.input[l.position:])
+	return max(size, 1)
 }
 
+// advance moves past the current character. Columns count characters, not
+// bytes. Invalid UTF-8 and byte order marks are reported wherever they
+// appear, including in strings and comments.
 func (l *Lexer) advance() {
-	l.position++
+	if err, bad := l.encodingError(); bad {
+		l.report(err)
+	}
+	l.position += l.charSize()
 	l.column++
 }
 
+// advanceBy skips the next n bytes, none of which may be a newline
+func (l *Lexer) advanceBy(n int) {
+	for end := l.position + n; l.position < end; {
+		l.advance()
+	}
+}
+
+// encodingError returns an error if the current character is not valid
+// UTF-8, or is a byte order mark after the start of the input
+func (l *Lexer) encodingError() (Diagnostic, bool) {
+	r, size := utf8.DecodeRuneInString(l.input[l.position:])
+	switch {
+	case r == utf8.RuneError && size == 1:
+		return l.errorf(CodeSyntax, "invalid UTF-8 encoding (byte %#x)", l.input[l.position]).
+			WithSuggestion("save the file as UTF-8"), true
+	case r == '\uFEFF':
+		return l.errorf(CodeSyntax, "byte order mark (U+FEFF) in the middle of the file").
+			WithSuggestion("remove the invisible character; a byte order mark may only start the file"), true
+	}
+	return Diagnostic{}, false
+}
+
+// pos returns the position of the next character
+func (l *Lexer) pos() Position {
+	return Position{Offset: l.position, Line: l.line, Column: l.column}
+}
+
+// closeBracket closes the innermost open bracket, which must be of type
+// opener. A closing bracket that does not match is reported, and closes
+// the matching bracket further out if there is one, or else the innermost
+// one, as a typo for its closing bracket.
+func (l *Lexer) closeBracket(opener TokenType) error {
+	closer := l.tokens[len(l.tokens)-1]
+	if len(l.brackets) == 0 {
+		return errorAt(closer, CodeSyntax, "unmatched '%s'", closer.Value)
+	}
+
+	innermost := l.brackets[len(l.brackets)-1]
+	open := len(l.brackets) - 1
+	for i := open; i >= 0; i-- {
+		if l.brackets[i].Type == opener {
+			open = i
+			break
+		}
+	}
+	l.brackets = l.brackets[:open]
+	if innermost.Type == opener {
+		return nil
+	}
+	return errorAt(closer, CodeSyntax, "closing '%s' does not match '%s'", closer.Value, innermost.Value).
+		WithNote("'%s' was opened at line %d", innermost.Value, innermost.Line)
+}
+
+// errorf returns a diagnostic for the character at the current position
+func (l *Lexer) errorf(code, format string, args ...any) Diagnostic {
+	to := l.pos()
+	if l.position < len(l.input) {
+		to.Offset += l.charSize()
+		to.Column++
+	}
+	return Errorf(Span{From: l.pos(), To: to}, code, format, args...)
+}
+
+// addToken adds a token that starts at l.start and ends at the current
+// position
 func (l *Lexer) addToken(tokenType TokenType, value string) {
 	l.tokens = append(l.tokens, Token{
 		Type:   tokenType,
 		Value:  value,
-		Line:   l.line,
-		Column: l.column,
+		Line:   l.start.Line,
+		Column: l.start.Column,
+		Offset: l.start.Offset,
+		End:    l.pos(),
 	})
 }
 
@@ -272,89 +549,490 @@ func (l *Lexer) skipWhitespace() {
 }
 
 func (l *Lexer) skipComment() {
-	for l.position < len(l.input) && l.currentChar() != '\n' {
+	for l.position < len(l.input) && l.currentChar() != '\n' && l.currentChar() != '\r' {
 		l.advance()
 	}
 }
 
-func (l *Lexer) scanString() error {
+// skipNewline consumes a Unix (\n) or Windows (\r\n) line ending
+func (l *Lexer) skipNewline() {
+	switch {
+	case l.currentChar() == '\r' && l.peekChar() == '\n':
+		l.advance()
+		l.advance()
+	case l.currentChar() == '\n' || l.currentChar() == '\r':
+		l.advance()
+	default:
+		return
+	}
+	l.line++
+	l.column = 1
+}
+
+// stringPrefix returns the prefix of a string literal at the current
+// position, as in r"..." or f"...", or "" when there is none
+func (l *Lexer) stringPrefix() string {
+	for _, prefix := range []string{"rf", "fr", "r", "f"} {
+		end := l.position + len(prefix)
+		if end < len(l.input) && strings.EqualFold(l.input[l.position:end], prefix) &&
+			(l.input[end] == '"' || l.input[end] == '\'') {
+			return l.input[l.position:end]
+		}
+	}
+	return ""
+}
+
+// scanString scans a string literal, after any prefix. Triple-quoted
+// strings may span lines, while other strings end with their line. Escape
+// sequences are decoded unless the string is raw. An f-string (format) is
+// scanned into several tokens, with the expressions of its replacement
+// fields tokenized like any other code.
+func (l *Lexer) scanString(raw, format bool) error {
+	start := l.start
 	quote := l.currentChar()
-	l.advance() // Skip opening quote
-	
-	start := l.position
-	for l.position < len(l.input) && l.currentChar() != quote {
-		if l.currentChar() == '\n' {
-			l.line++
-			l.column = 1
+	delimiter := string(quote)
+	if strings.HasPrefix(l.input[l.position:], strings.Repeat(delimiter, 3)) {
+		delimiter = strings.Repeat(delimiter, 3)
+	}
+	triple := len(delimiter) == 3
+	l.advanceBy(len(delimiter))
+	if format {
+		l.addToken(FSTRING_START, l.input[start.Offset:l.position])
+	}
+
+	var value strings.Builder
+	textStart := l.pos()
+	// flushText ends a run of literal text in an f-string
+	flushText := func() {
+		if value.Len() > 0 {
+			l.start = textStart
+			l.addToken(FSTRING_TEXT, value.String())
+			value.Reset()
 		}
+	}
+
+	for !strings.HasPrefix(l.input[l.position:], delimiter) {
+		ch := l.currentChar()
+		switch {
+		case l.position >= len(l.input) || !triple && (ch == '\n' || ch == '\r'):
+			return Errorf(Span{From: start, To: l.pos()}, CodeSyntax, "unterminated string").
+				WithSuggestion("add a closing %s", delimiter)
+
+		case ch == '\n' || ch == '\r':
+			value.WriteByte('\n')
+			l.skipNewline()
+
+		case ch == '\\' && raw:
+			// A backslash still keeps the quote after it from ending a raw
+			// string, but both are part of the value
+			value.WriteRune(ch)
+			l.advance()
+			if next := l.currentChar(); next == quote || next == '\\' {
+				value.WriteRune(next)
+				l.advance()
+			}
+
+		case ch == '\\':
+			// A bad escape is reported, and the rest of the string scanned
+			if err := l.scanEscape(&value); err != nil {
+				l.report(err)
+			}
+
+		case format && (ch == '{' || ch == '}') && l.peekChar() == ch:
+			// Doubled braces stand for themselves
+			value.WriteRune(ch)
+			l.advanceBy(2)
+
+		case format && ch == '{':
+			flushText()
+			if err := l.scanField(delimiter); err != nil {
+				l.report(err)
+			}
+			textStart = l.pos()
+
+		case format && ch == '}':
+			l.report(l.errorf(CodeSyntax, "single '}' is not allowed in an f-string").
+				WithSuggestion("write }} for a literal brace"))
+			l.advance()
+
+		default:
+			value.WriteRune(ch)
+			l.advance()
+		}
+	}
+
+	if format {
+		flushText()
+		l.start = l.pos()
+		l.advanceBy(len(delimiter))
+		l.addToken(FSTRING_END, delimiter)
+		return nil
+	}
+
+	l.advanceBy(len(delimiter))
+	l.addToken(STRING, value.String())
+	return nil
+}
+
+// scanField scans a replacement field of an f-string, from its opening
+// brace to its closing brace. The expression is tokenized like any other
+// code, and the format spec after a ':' is kept as text.
+func (l *Lexer) scanField(delimiter string) error {
+	l.start = l.pos()
+	end := l.fieldEnd(delimiter)
+	if end < 0 {
+		// The rest of the f-string is scanned as text
+		err := l.errorf(CodeSyntax, "replacement field in f-string is not closed").
+			WithSuggestion("close it with }, or write {{ for a literal brace")
 		l.advance()
+		return err
 	}
-	
-	if l.position >= len(l.input) {
-		return fmt.Errorf("unterminated string at line %d", l.line)
+	l.advance()
+	l.addToken(LBRACE, "{")
+	l.scanExpression(end)
+
+	if l.currentChar() == ':' {
+		l.advance()
+		l.start = l.pos()
+		close := strings.IndexByte(l.input[l.position:], '}')
+		if close < 0 || strings.ContainsAny(l.input[l.position:l.position+close], "\r\n"+delimiter[:1]) {
+			return l.errorf(CodeSyntax, "replacement field in f-string is not closed").
+				WithSuggestion("close it with }")
+		}
+		if strings.Contains(l.input[l.position:l.position+close], "{") {
+			err := l.errorf(CodeSyntax, "nested replacement fields in format specs are not supported")
+			l.advanceBy(close + 1)
+			return err
+		}
+		l.advanceBy(close)
+		l.addToken(FSTRING_SPEC, l.input[l.start.Offset:l.position])
 	}
-	
-	value := l.input[start:l.position]
-	l.advance() // Skip closing quote
-	
-	l.addToken(STRING, value)
+
+	l.start = l.pos()
+	l.advance()
+	l.addToken(RBRACE, "}")
 	return nil
 }
 
+// fieldEnd returns the offset of the ':' or '}' that ends the expression
+// of the replacement field whose '{' is at the current position, or -1
+// when the f-string ends first. Strings inside the expression must use
+// the other kind of quote.
+func (l *Lexer) fieldEnd(delimiter string) int {
+	depth := 0
+	for i := l.position + 1; i < len(l.input); i++ {
+		switch ch := l.input[i]; ch {
+		case '(', '[', '{':
+			depth++
+		case ')', ']':
+			depth--
+		case '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case ':':
+			if depth == 0 {
+				return i
+			}
+		case '\n', '\r':
+			if len(delimiter) == 1 {
+				return -1
+			}
+		case '"', '\'':
+			if strings.HasPrefix(l.input[i:], delimiter) {
+				return -1
+			}
+			end := strings.IndexByte(l.input[i+1:], ch)
+			if end < 0 {
+				return -1
+			}
+			i += end + 1
+		}
+	}
+	return -1
+}
+
+// scanExpression tokenizes the source from the current position up to
+// end, the expression of an f-string replacement field
+func (l *Lexer) scanExpression(end int) {
+	sub := &Lexer{
+		input:    l.input[:end],
+		position: l.position,
+		line:     l.line,
+		column:   l.column,
+		indents:  []int{0},
+	}
+	for sub.position < end {
+		start := sub.position
+		if err := sub.scanToken(); err != nil {
+			sub.report(err)
+			if sub.position == start {
+				sub.advance()
+			}
+		}
+	}
+
+	l.tokens = append(l.tokens, sub.tokens...)
+	for _, err := range sub.errors {
+		l.report(err)
+	}
+	l.position, l.line, l.column = sub.position, sub.line, sub.column
+}
+
+// escapes are the escape sequences that stand for a single character
+var escapes = map[rune]byte{
+	'\\': '\\',
+	'\'': '\'',
+	'"':  '"',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'0':  0,
+	'a':  '\a',
+	'b':  '\b',
+	'f':  '\f',
+	'v':  '\v',
+}
+
+// hexEscapes are the escape sequences that give a code point in hex, with
+// their number of digits
+var hexEscapes = map[rune]int{
+	'x': 2,
+	'u': 4,
+	'U': 8,
+}
+
+// scanEscape decodes the escape sequence starting with the backslash at
+// the current position
+func (l *Lexer) scanEscape(value *strings.Builder) error {
+	start := l.pos()
+	l.advance() // Skip backslash
+	ch := l.currentChar()
+
+	if decoded, ok := escapes[ch]; ok {
+		l.advance()
+		value.WriteByte(decoded)
+		return nil
+	}
+
+	// A backslash at the end of a line continues the string on the next
+	if ch == '\n' || ch == '\r' {
+		l.skipNewline()
+		return nil
+	}
+
+	if digits, ok := hexEscapes[ch]; ok {
+		l.advance()
+		hex := l.input[l.position:min(l.position+digits, len(l.input))]
+		code, err := strconv.ParseUint(hex, 16, 32)
+		if len(hex) < digits || err != nil {
+			return Errorf(Span{From: start, To: l.pos()}, CodeSyntax, "\\%c escape needs %d hex digits", ch, digits)
+		}
+		l.advanceBy(digits)
+		if !utf8.ValidRune(rune(code)) {
+			return Errorf(Span{From: start, To: l.pos()}, CodeSyntax, "\\%c%s is not a valid Unicode code point", ch, hex)
+		}
+		value.WriteRune(rune(code))
+		return nil
+	}
+
+	l.advance()
+	return Errorf(Span{From: start, To: l.pos()}, CodeSyntax, "unknown escape sequence \\%c", ch).
+		WithSuggestion("write \\\\ for a backslash, or use a raw string such as r\"C:\\dir\"")
+}
+
+// scanNumber scans an int or float literal, written as in Python: decimal,
+// hexadecimal (0xff), octal (0o17) or binary (0b1010) ints, and floats
+// with a fraction, an exponent or both (1.5, .5, 1e-9). Digits may be
+// grouped with single underscores, as in 1_000_000.
 func (l *Lexer) scanNumber() error {
 	start := l.position
-	
-	for l.position < len(l.input) && (isDigit(l.currentChar()) || l.currentChar() == '.') {
-		l.advance()
+	base, kind := 10, "decimal"
+	if l.currentChar() == '0' {
+		switch l.peekChar() {
+		case 'x', 'X':
+			base, kind = 16, "hexadecimal"
+		case 'o', 'O':
+			base, kind = 8, "octal"
+		case 'b', 'B':
+			base, kind = 2, "binary"
+		}
+	}
+
+	float := false
+	if base != 10 {
+		prefix := l.input[start : start+2]
+		l.advanceBy(2)
+		// An underscore may follow the prefix, as in 0x_ff
+		if l.currentChar() == '_' {
+			l.advance()
+		}
+		digits, err := l.scanDigits(base, kind)
+		if err != nil {
+			return err
+		}
+		if digits == 0 && !isAlnum(l.currentChar()) {
+			return l.numberError("invalid %s literal: no digits after %s", kind, prefix)
+		}
+	} else {
+		intDigits, err := l.scanDigits(10, kind)
+		if err != nil {
+			return err
+		}
+		if l.currentChar() == '.' {
+			float = true
+			l.advance()
+			if _, err := l.scanDigits(10, kind); err != nil {
+				return err
+			}
+		}
+		if ch := l.currentChar(); ch == 'e' || ch == 'E' {
+			float = true
+			l.advance()
+			if ch := l.currentChar(); ch == '+' || ch == '-' {
+				l.advance()
+			}
+			digits, err := l.scanDigits(10, kind)
+			if err != nil {
+				return err
+			}
+			if digits == 0 {
+				return l.numberError("invalid decimal literal: the exponent has no digits")
+			}
+		}
+		if text := l.input[start:l.position]; !float && intDigits > 1 && text[0] == '0' && strings.Trim(text, "0_") != "" {
+			return l.numberError("leading zeros are not allowed in decimal literals").
+				WithSuggestion("write 0o%s for an octal number", strings.TrimLeft(text, "0_"))
+		}
 	}
-	
+
+	switch ch := l.currentChar(); {
+	case ch == '.' && base != 10:
+		return l.numberError("invalid %s literal: only decimal numbers can have a fraction", kind)
+	case ch == '.':
+		return l.numberError("invalid number: a number has at most one decimal point")
+	case isDigit(ch):
+		return l.numberError("invalid digit '%c' in %s literal", ch, kind)
+	case isAlnum(ch):
+		return l.numberError("invalid %s literal", kind)
+	}
+
 	value := l.input[start:l.position]
+	if float {
+		if _, err := strconv.ParseFloat(value, 64); errors.Is(err, strconv.ErrRange) {
+			return l.numberError("float literal is too large")
+		}
+	} else if _, err := strconv.ParseInt(value, 0, 64); errors.Is(err, strconv.ErrRange) {
+		return l.numberError("integer literal is too large").
+			WithNote("ints are 64-bit; the largest is %d", math.MaxInt64)
+	}
 	l.addToken(NUMBER, value)
 	return nil
 }
 
+// scanDigits scans digits of the given base, which may be separated by
+// single underscores, and returns how many it read
+func (l *Lexer) scanDigits(base int, kind string) (int, error) {
+	digits := 0
+	for {
+		ch := l.currentChar()
+		if ch == '_' && digits > 0 {
+			if digitValue(l.peekChar()) >= base {
+				l.advance()
+				return digits, l.numberError("invalid %s literal: '_' must be between digits", kind)
+			}
+			l.advance()
+			continue
+		}
+		if digitValue(ch) >= base {
+			return digits, nil
+		}
+		digits++
+		l.advance()
+	}
+}
+
+// numberError reports a malformed number. The rest of its digits and
+// letters are skipped, so they are not scanned as further tokens.
+func (l *Lexer) numberError(format string, args ...any) Diagnostic {
+	for isAlnum(l.currentChar()) || l.currentChar() == '.' {
+		l.advance()
+	}
+	return Errorf(Span{From: l.start, To: l.pos()}, CodeSyntax, format, args...)
+}
+
+// digitValue returns the value of a hexadecimal digit, or 16 for any other
+// character
+func digitValue(ch rune) int {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return int(ch - '0')
+	case ch >= 'a' && ch <= 'f':
+		return int(ch-'a') + 10
+	case ch >= 'A' && ch <= 'F':
+		return int(ch-'A') + 10
+	}
+	return 16
+}
+
 func (l *Lexer) scanIdentifier() error {
 	start := l.position
-	
+
 	for l.position < len(l.input) && (isAlnum(l.currentChar()) || l.currentChar() == '_') {
 		l.advance()
 	}
-	
+
 	value := l.input[start:l.position]
 	tokenType := identifierType(value)
-	
+
 	l.addToken(tokenType, value)
 	return nil
 }
 
 func identifierType(value string) TokenType {
 	keywords := map[string]TokenType{
-		"print":  PRINT,
-		"if":     IF,
-		"else":   ELSE,
-		"def":    DEF,
-		"for":    FOR,
-		"in":     IN,
-		"while":  WHILE,
-		"return": RETURN,
-		"range":  IDENTIFIER, // range is treated as identifier/function
-	}
-	
+		"print":    PRINT,
+		"if":       IF,
+		"elif":     ELIF,
+		"else":     ELSE,
+		"def":      DEF,
+		"for":      FOR,
+		"in":       IN,
+		"while":    WHILE,
+		"return":   RETURN,
+		"break":    BREAK,
+		"continue": CONTINUE,
+		"del":      DEL,
+		"and":      AND,
+		"or":       OR,
+		"not":      NOT,
+		"True":     TRUE,
+		"False":    FALSE,
+		"None":     NONE,
+		"range":    IDENTIFIER, // range is treated as identifier/function
+	}
+
 	if tokenType, exists := keywords[value]; exists {
 		return tokenType
 	}
-	
+
 	return IDENTIFIER
 }
 
-func isDigit(ch byte) bool {
+func isDigit(ch rune) bool {
 	return ch >= '0' && ch <= '9'
 }
 
-func isAlpha(ch byte) bool {
-	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch == '_'
+// isAlpha reports whether ch can start an identifier. As in Go, that is a
+// Unicode letter or an underscore.
+func isAlpha(ch rune) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch == '_' ||
+		ch >= utf8.RuneSelf && unicode.IsLetter(ch)
 }
 
-func isAlnum(ch byte) bool {
-	return isAlpha(ch) || isDigit(ch)
+// isAlnum reports whether ch can continue an identifier: a letter, an
+// underscore or a Unicode decimal digit
+func isAlnum(ch rune) bool {
+	return isAlpha(ch) || isDigit(ch) || ch >= utf8.RuneSelf && unicode.IsDigit(ch)
 }
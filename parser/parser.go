@@ -1,94 +1,224 @@
 package parser
 
 import (
-	"fmt"
+	"errors"
+	"sort"
 )
 
 // Parser parses tokens into an AST
 type Parser struct {
-	tokens   []Token
-	current  int
-	indentLevel int
+	tokens        []Token
+	current       int
+	functionDepth int      // > 0 while parsing a def body
+	loopDepth     int      // > 0 while parsing a for or while body
+	blockDepth    int      // > 0 while parsing any indented block
+	lastEnd       Position // end of the last token consumed, layout tokens aside
+	errors        Diagnostics
 }
 
-// Parse converts a klo source string into an AST
+// Parse converts a klo source string into an AST. A statement that fails
+// to parse is skipped so that the rest of the program is still checked;
+// the error returned is then the Diagnostics for every problem found.
 func Parse(source string) (*Program, error) {
 	lexer := NewLexer(source)
 	tokens, err := lexer.Tokenize()
-	if err != nil {
+	lexErrors, ok := err.(Diagnostics)
+	if err != nil && !ok {
 		return nil, err
 	}
-	
+
 	parser := &Parser{
 		tokens:  tokens,
 		current: 0,
+		errors:  lexErrors,
+	}
+
+	program := parser.parseProgram()
+	if len(parser.errors) > 0 {
+		sort.SliceStable(parser.errors, func(i, j int) bool {
+			return parser.errors[i].Span.From.Offset < parser.errors[j].Span.From.Offset
+		})
+		return nil, parser.errors
 	}
-	
-	return parser.parseProgram()
+	return program, nil
 }
 
-func (p *Parser) parseProgram() (*Program, error) {
+func (p *Parser) parseProgram() *Program {
 	program := &Program{
 		Statements: []Statement{},
 	}
-	
+
 	for !p.isAtEnd() {
 		// Skip newlines at the beginning
 		if p.check(NEWLINE) {
 			p.advance()
 			continue
 		}
-		
+
+		if p.check(INDENT) {
+			p.unexpectedIndent()
+			continue
+		}
+
 		stmt, err := p.parseStatement()
 		if err != nil {
-			return nil, err
+			p.synchronize(err)
+			continue
 		}
-		
+
 		if stmt != nil {
 			program.Statements = append(program.Statements, stmt)
 		}
-		
+
 		// Skip trailing newlines
 		for p.check(NEWLINE) {
 			p.advance()
 		}
 	}
-	
-	return program, nil
+
+	return program
 }
 
 func (p *Parser) parseStatement() (Statement, error) {
+	start := p.peek()
+	stmt, err := p.parseStatementKind()
+	if err != nil {
+		return nil, err
+	}
+
+	// A statement ends its line, unless it ended with an indented block
+	if last := p.previous().Type; last != NEWLINE && last != DEDENT &&
+		!p.check(NEWLINE) && !p.check(DEDENT) && !p.isAtEnd() {
+		return nil, errorAt(p.peek(), CodeSyntax, "expected end of line after statement, got %s", p.peek().describe())
+	}
+
+	return finish(p, stmt, start.Pos()), nil
+}
+
+// synchronize records the error of a statement that failed to parse and
+// skips the rest of it: the remaining tokens of its line, and the block
+// the line opens, if any. Parsing then resumes with the next statement.
+func (p *Parser) synchronize(err error) {
+	p.report(err)
+	start := p.current
+	for !p.check(NEWLINE) && !p.check(DEDENT) && !p.isAtEnd() {
+		p.advance()
+	}
+	if !p.match(NEWLINE) && p.current == start && !p.isAtEnd() {
+		p.advance() // always make progress, even on a stray DEDENT
+	}
+	if p.check(INDENT) {
+		p.skipBlock()
+	}
+}
+
+// unexpectedIndent reports an indented block where none can start and
+// skips it
+func (p *Parser) unexpectedIndent() {
+	p.report(errorAt(p.peek(), CodeIndentation, "unexpected indent"))
+	p.skipBlock()
+}
+
+// skipBlock skips an INDENT and everything up to its matching DEDENT
+func (p *Parser) skipBlock() {
+	depth := 0
+	for !p.isAtEnd() {
+		switch p.advance().Type {
+		case INDENT:
+			depth++
+		case DEDENT:
+			depth--
+			if depth == 0 {
+				return
+			}
+		}
+	}
+}
+
+// report records a syntax error. Only the first error of each line is
+// kept, since later ones are usually caused by it.
+func (p *Parser) report(err error) {
+	var diagnostic Diagnostic
+	if !errors.As(err, &diagnostic) {
+		diagnostic = errorAt(p.peek(), CodeSyntax, "%v", err)
+	}
+	for _, reported := range p.errors {
+		if reported.Span.From.Line == diagnostic.Span.From.Line {
+			return
+		}
+	}
+	p.errors = append(p.errors, diagnostic)
+}
+
+func (p *Parser) parseStatementKind() (Statement, error) {
 	if p.check(PRINT) {
 		return p.parsePrintStatement()
 	}
-	
+
 	if p.check(IF) {
 		return p.parseIfStatement()
 	}
-	
+
 	if p.check(FOR) {
 		return p.parseForStatement()
 	}
-	
+
+	if p.check(WHILE) {
+		return p.parseWhileStatement()
+	}
+
+	if p.check(BREAK) || p.check(CONTINUE) {
+		return p.parseLoopControl()
+	}
+
+	if p.check(DEF) {
+		return p.parseFunctionDefinition()
+	}
+
+	if p.check(DEL) {
+		return p.parseDeleteStatement()
+	}
+
+	if p.check(RETURN) {
+		return p.parseReturnStatement()
+	}
+
 	// Check for assignment
 	if p.check(IDENTIFIER) && p.checkNext(ASSIGN) {
 		return p.parseAssignmentStatement()
 	}
-	
+
 	// Expression statement
 	expr, err := p.parseExpression()
 	if err != nil {
 		return nil, err
 	}
-	
+
+	// Assignment to an element, as in xs[i] = v
+	if p.check(ASSIGN) {
+		target, ok := expr.(*IndexExpression)
+		if !ok {
+			return nil, Errorf(SpanOf(expr), CodeSyntax, "cannot assign to %s", expr).
+				WithSuggestion("only variables and elements such as xs[i] can be assigned")
+		}
+		p.advance()
+
+		value, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+
+		return &IndexAssignmentStatement{Target: target, Value: value}, nil
+	}
+
 	return &ExpressionStatement{Expression: expr}, nil
 }
 
 func (p *Parser) parsePrintStatement() (*PrintStatement, error) {
-	p.consume(PRINT, "Expected 'print'")
-	
+	p.advance() // consume 'print'
+
 	args := []Expression{}
-	
+
 	// Parse first argument
 	if !p.check(NEWLINE) && !p.isAtEnd() {
 		expr, err := p.parseExpression()
@@ -96,7 +226,7 @@ func (p *Parser) parsePrintStatement() (*PrintStatement, error) {
 			return nil, err
 		}
 		args = append(args, expr)
-		
+
 		// Parse additional arguments separated by commas
 		for p.match(COMMA) {
 			expr, err := p.parseExpression()
@@ -106,24 +236,26 @@ func (p *Parser) parsePrintStatement() (*PrintStatement, error) {
 			args = append(args, expr)
 		}
 	}
-	
+
 	return &PrintStatement{Arguments: args}, nil
 }
 
 func (p *Parser) parseAssignmentStatement() (*AssignmentStatement, error) {
 	if !p.check(IDENTIFIER) {
-		return nil, fmt.Errorf("expected identifier")
+		return nil, errorAt(p.peek(), CodeSyntax, "expected identifier, got %s", p.peek().describe())
 	}
-	
+
 	name := p.peek().Value
 	p.advance() // consume identifier
-	p.consume(ASSIGN, "Expected '='")
-	
+	if err := p.consume(ASSIGN, "Expected '='"); err != nil {
+		return nil, err
+	}
+
 	value, err := p.parseExpression()
 	if err != nil {
 		return nil, err
 	}
-	
+
 	return &AssignmentStatement{
 		Name:  name,
 		Value: value,
@@ -131,131 +263,352 @@ func (p *Parser) parseAssignmentStatement() (*AssignmentStatement, error) {
 }
 
 func (p *Parser) parseIfStatement() (*IfStatement, error) {
-	p.consume(IF, "Expected 'if'")
-	
-	condition, err := p.parseExpression()
-	if err != nil {
-		return nil, err
-	}
-	
-	p.consume(COLON, "Expected ':' after if condition")
-	
-	// Skip newline after colon
-	if p.check(NEWLINE) {
-		p.advance()
-	}
-	
-	// Parse indented body
-	body, err := p.parseIndentedBlock()
-	if err != nil {
-		return nil, err
+	p.advance() // consume 'if'
+
+	stmt := &IfStatement{}
+
+	// Each branch starts at its if or elif keyword
+	start := p.previous()
+	for {
+		condition, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.consume(COLON, "Expected ':' after if condition"); err != nil {
+			return nil, err
+		}
+
+		// Parse indented body
+		body, err := p.parseIndentedBlock()
+		if err != nil {
+			return nil, err
+		}
+
+		stmt.Branches = append(stmt.Branches, IfBranch{
+			Span:      Span{From: start.Pos(), To: p.lastEnd},
+			Condition: condition,
+			Body:      body,
+		})
+
+		// A single-line body leaves its NEWLINE in front of elif/else
+		if p.check(NEWLINE) && (p.checkNext(ELIF) || p.checkNext(ELSE)) {
+			p.advance()
+		}
+
+		if !p.match(ELIF) {
+			break
+		}
+		start = p.previous()
 	}
-	
-	var elseBody []Statement
-	
+
 	// Check for else clause
 	if p.check(ELSE) {
-		p.advance()
-		p.consume(COLON, "Expected ':' after else")
-		
-		if p.check(NEWLINE) {
-			p.advance()
+		stmt.ElsePos = p.advance().Pos()
+		if err := p.consume(COLON, "Expected ':' after else"); err != nil {
+			return nil, err
 		}
-		
-		elseBody, err = p.parseIndentedBlock()
+
+		elseBody, err := p.parseIndentedBlock()
 		if err != nil {
 			return nil, err
 		}
+		stmt.Else = elseBody
 	}
-	
-	return &IfStatement{
-		Condition: condition,
-		Body:      body,
-		Else:      elseBody,
-	}, nil
+
+	return stmt, nil
 }
 
 func (p *Parser) parseForStatement() (*ForStatement, error) {
-	p.consume(FOR, "Expected 'for'")
-	
+	p.advance() // consume 'for'
+
 	// Parse variable name (e.g., "i" in "for i in range(5)")
 	if !p.check(IDENTIFIER) {
-		return nil, fmt.Errorf("expected variable name after 'for'")
+		return nil, errorAt(p.peek(), CodeSyntax, "expected variable name after 'for', got %s", p.peek().describe())
 	}
 	variable := p.peek().Value
 	p.advance()
-	
-	p.consume(IN, "Expected 'in' after for variable")
-	
+
+	// A second variable, as in "for k, v in d.items()"
+	valueVariable := ""
+	if p.match(COMMA) {
+		if !p.check(IDENTIFIER) {
+			return nil, errorAt(p.peek(), CodeSyntax, "expected second variable name after ',', got %s", p.peek().describe())
+		}
+		valueVariable = p.advance().Value
+	}
+
+	if err := p.consume(IN, "Expected 'in' after for variable"); err != nil {
+		return nil, err
+	}
+
 	// Parse iterable (e.g., range(5))
 	iterable, err := p.parseExpression()
 	if err != nil {
 		return nil, err
 	}
-	
-	p.consume(COLON, "Expected ':' after for expression")
-	
-	// Skip newline after colon
-	if p.check(NEWLINE) {
-		p.advance()
+
+	if err := p.consume(COLON, "Expected ':' after for expression"); err != nil {
+		return nil, err
 	}
-	
+
 	// Parse indented body
-	body, err := p.parseIndentedBlock()
+	body, err := p.parseLoopBody()
 	if err != nil {
 		return nil, err
 	}
-	
+
 	return &ForStatement{
-		Variable: variable,
-		Iterable: iterable,
-		Body:     body,
+		Variable:      variable,
+		ValueVariable: valueVariable,
+		Iterable:      iterable,
+		Body:          body,
 	}, nil
 }
 
-func (p *Parser) parseIndentedBlock() ([]Statement, error) {
-	statements := []Statement{}
-	
-	// Skip initial whitespace/indentation
-	for p.check(NEWLINE) {
-		p.advance()
+func (p *Parser) parseDeleteStatement() (*DeleteStatement, error) {
+	del := p.advance()
+
+	expr, err := p.parseExpression()
+	if err != nil {
+		return nil, err
 	}
-	
-	// Parse statements until we hit a non-indented line or EOF
-	for !p.isAtEnd() {
-		// Skip empty lines
-		if p.check(NEWLINE) {
-			p.advance()
-			continue
-		}
-		
-		// If we hit a keyword that starts a new block (if, for, etc), we're done
-		if p.check(IF) || p.check(FOR) || p.check(ELSE) {
-			break
+
+	target, ok := expr.(*IndexExpression)
+	if !ok {
+		return nil, Errorf(Span{From: del.Pos(), To: expr.End()}, CodeSyntax, "'del' needs an element such as d[key]")
+	}
+
+	return &DeleteStatement{Target: target}, nil
+}
+
+func (p *Parser) parseWhileStatement() (*WhileStatement, error) {
+	p.advance() // consume 'while'
+
+	condition, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.consume(COLON, "Expected ':' after while condition"); err != nil {
+		return nil, err
+	}
+
+	body, err := p.parseLoopBody()
+	if err != nil {
+		return nil, err
+	}
+
+	return &WhileStatement{
+		Condition: condition,
+		Body:      body,
+	}, nil
+}
+
+// parseLoopBody parses the body of a for or while loop, where break and
+// continue are allowed
+func (p *Parser) parseLoopBody() ([]Statement, error) {
+	p.loopDepth++
+	defer func() { p.loopDepth-- }()
+
+	return p.parseIndentedBlock()
+}
+
+func (p *Parser) parseLoopControl() (Statement, error) {
+	token := p.advance()
+	if p.loopDepth == 0 {
+		return nil, errorAt(token, CodeMisplaced, "'%s' outside loop", token.Value)
+	}
+
+	if token.Type == BREAK {
+		return &BreakStatement{}, nil
+	}
+	return &ContinueStatement{}, nil
+}
+
+func (p *Parser) parseFunctionDefinition() (*FunctionDefinition, error) {
+	def := p.advance()
+	if p.blockDepth > 0 {
+		return nil, errorAt(def, CodeMisplaced, "functions can only be defined at the top level")
+	}
+
+	if !p.check(IDENTIFIER) {
+		return nil, errorAt(p.peek(), CodeSyntax, "expected function name after 'def', got %s", p.peek().describe())
+	}
+	name := p.advance().Value
+
+	if err := p.consume(LPAREN, "Expected '(' after function name"); err != nil {
+		return nil, err
+	}
+
+	params := []string{}
+	seen := map[string]bool{}
+	if !p.check(RPAREN) {
+		for {
+			if !p.check(IDENTIFIER) {
+				return nil, errorAt(p.peek(), CodeSyntax, "expected parameter name in definition of '%s', got %s", name, p.peek().describe())
+			}
+			token := p.advance()
+			param := token.Value
+			if seen[param] {
+				return nil, errorAt(token, CodeSyntax, "duplicate parameter '%s' in definition of '%s'", param, name)
+			}
+			seen[param] = true
+			params = append(params, param)
+
+			if !p.match(COMMA) {
+				break
+			}
 		}
-		
+	}
+
+	if err := p.consume(RPAREN, "Expected ')' after parameters"); err != nil {
+		return nil, err
+	}
+	if err := p.consume(COLON, "Expected ':' after function signature"); err != nil {
+		return nil, err
+	}
+
+	// A loop around the def does not make break valid inside its body
+	outerLoopDepth := p.loopDepth
+	p.functionDepth++
+	p.loopDepth = 0
+	body, err := p.parseIndentedBlock()
+	p.functionDepth--
+	p.loopDepth = outerLoopDepth
+	if err != nil {
+		return nil, err
+	}
+
+	return &FunctionDefinition{
+		Name:       name,
+		Parameters: params,
+		Body:       body,
+	}, nil
+}
+
+func (p *Parser) parseReturnStatement() (*ReturnStatement, error) {
+	ret := p.advance()
+	if p.functionDepth == 0 {
+		return nil, errorAt(ret, CodeMisplaced, "'return' outside function")
+	}
+
+	// A bare return ends at the end of the line
+	if p.check(NEWLINE) || p.check(DEDENT) || p.isAtEnd() {
+		return &ReturnStatement{}, nil
+	}
+
+	value, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReturnStatement{Value: value}, nil
+}
+
+// parseIndentedBlock parses the body that follows a ':'. The body is
+// either a single statement on the same line or a NEWLINE followed by an
+// INDENT, any number of statements and the matching DEDENT.
+func (p *Parser) parseIndentedBlock() ([]Statement, error) {
+	p.blockDepth++
+	defer func() { p.blockDepth-- }()
+
+	if !p.check(NEWLINE) {
 		stmt, err := p.parseStatement()
 		if err != nil {
 			return nil, err
 		}
-		
-		if stmt != nil {
-			statements = append(statements, stmt)
+		return []Statement{stmt}, nil
+	}
+	p.advance()
+
+	// A missing block is reported, and the statement kept with an empty
+	// body, so that the lines that follow are parsed as usual
+	if !p.check(INDENT) {
+		p.report(errorAt(p.peek(), CodeIndentation, "expected an indented block, got %s", p.peek().describe()))
+		return []Statement{}, nil
+	}
+	p.advance()
+
+	statements := []Statement{}
+	for !p.check(DEDENT) && !p.isAtEnd() {
+		if p.match(NEWLINE) {
+			continue
 		}
-		
-		// Skip newlines after statement
-		for p.check(NEWLINE) {
-			p.advance()
+
+		if p.check(INDENT) {
+			p.unexpectedIndent()
+			continue
 		}
-		
-		// Break after first statement for now (simple approach)
-		break
+
+		stmt, err := p.parseStatement()
+		if err != nil {
+			p.synchronize(err)
+			continue
+		}
+		statements = append(statements, stmt)
 	}
-	
+	p.match(DEDENT)
+
 	return statements, nil
 }
 
 func (p *Parser) parseExpression() (Expression, error) {
+	return p.parseOr()
+}
+
+func (p *Parser) parseOr() (Expression, error) {
+	expr, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.match(OR) {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		expr = finish(p, &BinaryExpression{
+			Left:     expr,
+			Operator: "or",
+			Right:    right,
+		}, expr.Pos())
+	}
+
+	return expr, nil
+}
+
+func (p *Parser) parseAnd() (Expression, error) {
+	expr, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.match(AND) {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		expr = finish(p, &BinaryExpression{
+			Left:     expr,
+			Operator: "and",
+			Right:    right,
+		}, expr.Pos())
+	}
+
+	return expr, nil
+}
+
+func (p *Parser) parseNot() (Expression, error) {
+	if p.match(NOT) {
+		start := p.previous().Pos()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return finish(p, &UnaryExpression{Operator: "not", Operand: operand}, start), nil
+	}
+
 	return p.parseComparison()
 }
 
@@ -264,21 +617,30 @@ func (p *Parser) parseComparison() (Expression, error) {
 	if err != nil {
 		return nil, err
 	}
-	
-	for p.match(GREATER, GREATER_EQ, LESS, LESS_EQ, EQUAL, NOT_EQUAL) {
-		operator := p.previous().Value
+
+	for {
+		var operator string
+		switch {
+		case p.check(NOT) && p.checkNext(IN):
+			p.advance()
+			p.advance()
+			operator = "not in"
+		case p.match(GREATER, GREATER_EQ, LESS, LESS_EQ, EQUAL, NOT_EQUAL, IN):
+			operator = p.previous().Value
+		default:
+			return expr, nil
+		}
+
 		right, err := p.parseAddition()
 		if err != nil {
 			return nil, err
 		}
-		expr = &BinaryExpression{
+		expr = finish(p, &BinaryExpression{
 			Left:     expr,
 			Operator: operator,
 			Right:    right,
-		}
+		}, expr.Pos())
 	}
-	
-	return expr, nil
 }
 
 func (p *Parser) parseAddition() (Expression, error) {
@@ -286,84 +648,290 @@ func (p *Parser) parseAddition() (Expression, error) {
 	if err != nil {
 		return nil, err
 	}
-	
+
 	for p.match(MINUS, PLUS) {
 		operator := p.previous().Value
 		right, err := p.parseMultiplication()
 		if err != nil {
 			return nil, err
 		}
-		expr = &BinaryExpression{
+		expr = finish(p, &BinaryExpression{
 			Left:     expr,
 			Operator: operator,
 			Right:    right,
-		}
+		}, expr.Pos())
 	}
-	
+
 	return expr, nil
 }
 
 func (p *Parser) parseMultiplication() (Expression, error) {
-	expr, err := p.parsePrimary()
+	expr, err := p.parseUnary()
 	if err != nil {
 		return nil, err
 	}
-	
+
 	for p.match(DIVIDE, MULTIPLY, MODULO) {
 		operator := p.previous().Value
-		right, err := p.parsePrimary()
+		right, err := p.parseUnary()
 		if err != nil {
 			return nil, err
 		}
-		expr = &BinaryExpression{
+		expr = finish(p, &BinaryExpression{
 			Left:     expr,
 			Operator: operator,
 			Right:    right,
-		}
+		}, expr.Pos())
 	}
-	
+
 	return expr, nil
 }
 
+func (p *Parser) parseUnary() (Expression, error) {
+	if p.match(MINUS, PLUS) {
+		operator := p.previous()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return finish(p, &UnaryExpression{Operator: operator.Value, Operand: operand}, operator.Pos()), nil
+	}
+
+	return p.parseCall()
+}
+
+// parseCall parses a primary expression followed by any number of calls,
+// index operations and attribute accesses
+func (p *Parser) parseCall() (Expression, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case p.match(LPAREN):
+			args, err := p.parseExpressionList(RPAREN)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := p.consume(RPAREN, "Expected ')' after arguments"); err != nil {
+				return nil, err
+			}
+
+			expr = finish(p, &CallExpression{
+				Function:  expr,
+				Arguments: args,
+			}, expr.Pos())
+
+		case p.match(LBRACKET):
+			index, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+
+			if err := p.consume(RBRACKET, "Expected ']' after index"); err != nil {
+				return nil, err
+			}
+
+			expr = finish(p, &IndexExpression{
+				Object: expr,
+				Index:  index,
+			}, expr.Pos())
+
+		case p.match(DOT):
+			if !p.check(IDENTIFIER) {
+				return nil, errorAt(p.peek(), CodeSyntax, "expected attribute name after '.', got %s", p.peek().describe())
+			}
+
+			name := p.advance().Value
+			expr = finish(p, &MemberExpression{
+				Object: expr,
+				Name:   name,
+			}, expr.Pos())
+
+		default:
+			return expr, nil
+		}
+	}
+}
+
+func (p *Parser) parseDictLiteral() (*DictLiteral, error) {
+	start := p.previous().Pos()
+	dict := &DictLiteral{Entries: []DictEntry{}}
+
+	for !p.check(RBRACE) && !p.isAtEnd() {
+		key, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.consume(COLON, "Expected ':' after dictionary key"); err != nil {
+			return nil, err
+		}
+
+		value, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+
+		dict.Entries = append(dict.Entries, DictEntry{Key: key, Value: value})
+
+		if !p.match(COMMA) {
+			break
+		}
+	}
+
+	if err := p.consume(RBRACE, "Expected '}' after dictionary entries"); err != nil {
+		return nil, err
+	}
+
+	return finish(p, dict, start), nil
+}
+
+// parseExpressionList parses comma-separated expressions up to (but not
+// including) the closing token. A trailing comma is allowed.
+func (p *Parser) parseExpressionList(closing TokenType) ([]Expression, error) {
+	exprs := []Expression{}
+
+	for !p.check(closing) && !p.isAtEnd() {
+		expr, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+
+		if !p.match(COMMA) {
+			break
+		}
+	}
+
+	return exprs, nil
+}
+
 func (p *Parser) parsePrimary() (Expression, error) {
+	start := p.peek().Pos()
+
 	if p.match(NUMBER) {
-		return &NumberLiteral{Value: p.previous().Value}, nil
+		return finish(p, NewNumberLiteral(p.previous().Value), start), nil
 	}
-	
+
 	if p.match(STRING) {
-		return &StringLiteral{Value: p.previous().Value}, nil
+		return finish(p, &StringLiteral{Value: p.previous().Value}, start), nil
 	}
-	
+
+	if p.match(FSTRING_START) {
+		return p.parseInterpolatedString(start)
+	}
+
+	if p.match(TRUE, FALSE) {
+		return finish(p, &BooleanLiteral{Value: p.previous().Type == TRUE}, start), nil
+	}
+
+	if p.match(NONE) {
+		return finish(p, &NoneLiteral{}, start), nil
+	}
+
 	if p.match(IDENTIFIER) {
 		name := p.previous().Value
-		
-		// Check for function call like range(5)
+
+		// Check for function call like range(5) or range(1, 10, 2)
 		if p.check(LPAREN) && name == "range" {
 			p.advance() // consume '('
-			
-			expr, err := p.parseExpression()
+
+			args, err := p.parseExpressionList(RPAREN)
 			if err != nil {
 				return nil, err
 			}
-			
-			p.consume(RPAREN, "Expected ')' after range argument")
-			
-			return &RangeExpression{End: expr}, nil
+
+			if err := p.consume(RPAREN, "Expected ')' after range arguments"); err != nil {
+				return nil, err
+			}
+
+			switch len(args) {
+			case 1:
+				return finish(p, &RangeExpression{Stop: args[0]}, start), nil
+			case 2:
+				return finish(p, &RangeExpression{Start: args[0], Stop: args[1]}, start), nil
+			case 3:
+				return finish(p, &RangeExpression{Start: args[0], Stop: args[1], Step: args[2]}, start), nil
+			default:
+				return nil, Errorf(Span{From: start, To: p.lastEnd}, CodeSyntax, "range() takes 1 to 3 arguments, got %d", len(args))
+			}
 		}
-		
-		return &Identifier{Value: name}, nil
+
+		return finish(p, &Identifier{Value: name}, start), nil
 	}
-	
+
 	if p.match(LPAREN) {
 		expr, err := p.parseExpression()
 		if err != nil {
 			return nil, err
 		}
-		p.consume(RPAREN, "Expected ')' after expression")
+		if err := p.consume(RPAREN, "Expected ')' after expression"); err != nil {
+			return nil, err
+		}
 		return expr, nil
 	}
-	
-	return nil, fmt.Errorf("unexpected token: %v", p.peek())
+
+	if p.match(LBRACKET) {
+		elements, err := p.parseExpressionList(RBRACKET)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.consume(RBRACKET, "Expected ']' after list elements"); err != nil {
+			return nil, err
+		}
+
+		return finish(p, &ListLiteral{Elements: elements}, start), nil
+	}
+
+	if p.match(LBRACE) {
+		return p.parseDictLiteral()
+	}
+
+	return nil, errorAt(p.peek(), CodeSyntax, "unexpected %s", p.peek().describe())
+}
+
+// parseInterpolatedString parses the rest of an f-string, after its
+// FSTRING_START token
+func (p *Parser) parseInterpolatedString(start Position) (Expression, error) {
+	str := &InterpolatedString{}
+	for !p.match(FSTRING_END) {
+		switch {
+		case p.match(FSTRING_TEXT):
+			text := p.previous()
+			str.Parts = append(str.Parts, InterpolationPart{
+				Span: Span{From: text.Pos(), To: text.End},
+				Text: text.Value,
+			})
+
+		case p.match(LBRACE):
+			open := p.previous()
+			if p.check(RBRACE) || p.check(FSTRING_SPEC) {
+				return nil, errorAt(p.peek(), CodeSyntax, "empty expression in f-string")
+			}
+			value, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			part := InterpolationPart{Value: value}
+			if p.match(FSTRING_SPEC) {
+				part.Spec = p.previous().Value
+			}
+			if err := p.consume(RBRACE, "Expected '}' after f-string expression"); err != nil {
+				return nil, err
+			}
+			part.Span = Span{From: open.Pos(), To: p.lastEnd}
+			str.Parts = append(str.Parts, part)
+
+		default:
+			return nil, errorAt(p.peek(), CodeSyntax, "unexpected %s in f-string", p.peek().describe())
+		}
+	}
+	return finish(p, str, start), nil
 }
 
 // Helper methods
@@ -385,17 +953,30 @@ func (p *Parser) check(tokenType TokenType) bool {
 }
 
 func (p *Parser) checkNext(tokenType TokenType) bool {
-	if p.current + 1 >= len(p.tokens) {
+	if p.current+1 >= len(p.tokens) {
 		return false
 	}
-	return p.tokens[p.current + 1].Type == tokenType
+	return p.tokens[p.current+1].Type == tokenType
 }
 
 func (p *Parser) advance() Token {
 	if !p.isAtEnd() {
 		p.current++
 	}
-	return p.previous()
+	token := p.previous()
+	switch token.Type {
+	case NEWLINE, INDENT, DEDENT, EOF:
+	default:
+		p.lastEnd = token.End
+	}
+	return token
+}
+
+// finish sets the span of a node that starts at start and ends with the
+// last token consumed
+func finish[N interface{ setSpan(Span) }](p *Parser, node N, start Position) N {
+	node.setSpan(Span{From: start, To: p.lastEnd})
+	return node
 }
 
 func (p *Parser) isAtEnd() bool {
@@ -415,6 +996,11 @@ func (p *Parser) consume(tokenType TokenType, message string) error {
 		p.advance()
 		return nil
 	}
-	
-	return fmt.Errorf("%s, got %v", message, p.peek())
+
+	return errorAt(p.peek(), CodeSyntax, "%s, got %s", message, p.peek().describe())
+}
+
+// errorAt returns a diagnostic for a token
+func errorAt(token Token, code, format string, args ...any) Diagnostic {
+	return Errorf(Span{From: token.Pos(), To: token.End}, code, format, args...)
 }
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/singleservingfriend/klo/interp"
+	"github.com/singleservingfriend/klo/parser"
+	"github.com/singleservingfriend/klo/transpiler"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+// replFile is the file name diagnostics and generated Go code give to
+// REPL inputs
+const replFile = "repl"
+
+const replHelp = `Type klo statements to run them. A line ending in ':' opens a block,
+which ends at an empty line. The value of an expression is printed. The
+up and down arrows recall earlier lines, and a def replaces an earlier
+function of the same name.
+
+  :help           show this help
+  :reset          forget all variables and functions
+  :load file.klo  run a file, keeping its variables and functions
+  :go             show the Go code generated for the last input
+  :history        list the inputs run so far
+  :quit           leave the REPL (or press Ctrl-D)
+`
+
+// startRepl runs the interactive REPL on standard input
+func startRepl(c *cli.Context) error {
+	// Prompts are only shown to a person typing at a terminal
+	interactive := false
+	if stat, err := os.Stdin.Stat(); err == nil {
+		interactive = stat.Mode()&os.ModeCharDevice != 0
+	}
+
+	var in lineReader = &scannerReader{scanner: bufio.NewScanner(os.Stdin)}
+	if interactive {
+		fmt.Printf("klo %s REPL. Type :help for help.\n", c.App.Version)
+		in = &scannerReader{scanner: bufio.NewScanner(os.Stdin), prompts: os.Stdout}
+		if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+			in = newEditorReader(fd)
+		}
+	}
+	repl := &repl{
+		in:          in,
+		out:         os.Stdout,
+		errOut:      os.Stderr,
+		interactive: interactive,
+	}
+	repl.run()
+	return nil
+}
+
+// lineReader reads the lines of REPL inputs, showing a prompt before each
+// when a person is typing. The second result is false at the end of input.
+type lineReader interface {
+	readLine(prompt string) (string, bool)
+}
+
+// scannerReader reads lines from input that is not a terminal
+type scannerReader struct {
+	scanner *bufio.Scanner
+	prompts io.Writer // where prompts are shown, nil for none
+}
+
+func (s *scannerReader) readLine(prompt string) (string, bool) {
+	if s.prompts != nil {
+		fmt.Fprint(s.prompts, prompt)
+	}
+	if !s.scanner.Scan() {
+		return "", false
+	}
+	return s.scanner.Text(), true
+}
+
+// editorReader reads lines typed at a terminal with a line editor: the
+// arrow keys move along the line, and up and down recall earlier lines.
+// The terminal is only in raw mode while a line is read, so that Ctrl-C
+// still stops a program that runs too long.
+type editorReader struct {
+	fd       int
+	terminal *term.Terminal
+}
+
+func newEditorReader(fd int) *editorReader {
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "")
+	return &editorReader{fd: fd, terminal: terminal}
+}
+
+func (e *editorReader) readLine(prompt string) (string, bool) {
+	if state, err := term.MakeRaw(e.fd); err == nil {
+		defer term.Restore(e.fd, state)
+	}
+	if width, height, err := term.GetSize(e.fd); err == nil && width > 0 {
+		e.terminal.SetSize(width, height)
+	}
+	e.terminal.SetPrompt(prompt)
+
+	// Pasted lines come with ErrPasteIndicator, and are read as if typed
+	line, err := e.terminal.ReadLine()
+	return line, err == nil || err == term.ErrPasteIndicator
+}
+
+// repl reads inputs and runs them in a session
+type repl struct {
+	in          lineReader
+	out         io.Writer
+	errOut      io.Writer
+	interactive bool
+	session     *session
+	history     []string
+}
+
+// run reads and runs inputs until the end of input or :quit
+func (r *repl) run() {
+	r.session = newSession(r.out)
+	for {
+		input, ok := r.read()
+		if !ok {
+			if r.interactive {
+				fmt.Fprintln(r.out)
+			}
+			return
+		}
+
+		if strings.TrimSpace(input) == "" {
+			continue
+		}
+		switch command, arg, _ := strings.Cut(strings.TrimSpace(input), " "); {
+		case !strings.HasPrefix(command, ":"):
+			r.history = append(r.history, input)
+			r.session.run(input, r.errOut)
+		case command == ":quit" || command == ":exit":
+			return
+		default:
+			r.command(command, strings.TrimSpace(arg))
+		}
+	}
+}
+
+// read reads one input: a single line, or the lines of a block up to an
+// empty line, or the lines up to the one closing an open bracket or
+// triple-quoted string. The second result is false at the end of input.
+func (r *repl) read() (string, bool) {
+	var lines []string
+	prompt := ">>> "
+	for {
+		line, ok := r.in.readLine(prompt)
+		if !ok {
+			// A block typed just before the end of input is still run
+			return strings.Join(lines, "\n"), len(lines) > 0
+		}
+
+		if len(lines) > 0 && strings.TrimSpace(line) == "" {
+			return strings.Join(lines, "\n"), true
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(strings.TrimSpace(lines[0]), ":") || !incomplete(strings.Join(lines, "\n")) {
+			return strings.Join(lines, "\n"), true
+		}
+		prompt = "... "
+	}
+}
+
+// command runs a REPL command such as :load
+func (r *repl) command(command, arg string) {
+	switch command {
+	case ":help":
+		fmt.Fprint(r.out, replHelp)
+	case ":reset":
+		r.session = newSession(r.out)
+	case ":load":
+		if arg == "" {
+			fmt.Fprintln(r.errOut, "usage: :load file.klo")
+			return
+		}
+		source, err := os.ReadFile(arg)
+		if err != nil {
+			fmt.Fprintf(r.errOut, "error reading file: %v\n", err)
+			return
+		}
+		r.history = append(r.history, command+" "+arg)
+		r.session.run(string(source), r.errOut)
+	case ":go":
+		code, err := r.session.goCode()
+		if err != nil {
+			fmt.Fprintln(r.errOut, err)
+			return
+		}
+		fmt.Fprint(r.out, code)
+	case ":history":
+		for i, input := range r.history {
+			fmt.Fprintf(r.out, "%4d  %s\n", i+1, strings.ReplaceAll(input, "\n", "\n      "))
+		}
+	default:
+		fmt.Fprintf(r.errOut, "unknown command %s, type :help for the list of commands\n", command)
+	}
+}
+
+// incomplete reports whether an input needs more lines: it opens a block,
+// or leaves a bracket or a triple-quoted string open
+func incomplete(input string) bool {
+	tokens, err := parser.NewLexer(input).Tokenize()
+
+	var diagnostics parser.Diagnostics
+	errors.As(err, &diagnostics)
+	for _, diagnostic := range diagnostics {
+		switch {
+		case strings.HasSuffix(diagnostic.Message, "was never closed"):
+			return true
+		case diagnostic.Message == "unterminated string" && diagnostic.Span.To.Offset == len(input):
+			// Only triple-quoted strings go on past the end of a line
+			text := strings.TrimLeft(input[diagnostic.Span.From.Offset:], "rRfF")
+			return strings.HasPrefix(text, `"""`) || strings.HasPrefix(text, "'''")
+		}
+	}
+
+	// A colon at the end of a line opens a block on the lines after it
+	for i := 1; i < len(tokens); i++ {
+		if tokens[i-1].Type == parser.COLON && tokens[i].Type == parser.NEWLINE {
+			return true
+		}
+	}
+	return false
+}
+
+// session holds the inputs run so far as one program, and the
+// interpreter holding its variables and functions. Only the statements of
+// the new input are type checked and run, along with the functions of
+// earlier inputs, and the variables of earlier inputs have the types of
+// the values they hold, so that an input can assign a variable a value of
+// another type. A def replaces the defs of the same name in earlier
+// inputs, which are left out of the program.
+type session struct {
+	interpreter *interp.Interpreter
+	source      string          // the inputs run so far, one after the other
+	program     *parser.Program // the program they make up
+	start       parser.Position // where the last input starts in source
+}
+
+func newSession(out io.Writer) *session {
+	return &session{interpreter: interp.New(out)}
+}
+
+// run adds an input to the program and runs its statements. An input that
+// does not parse or type check is dropped; one that fails at run time is
+// kept, along with the variables it set.
+func (s *session) run(input string, errOut io.Writer) {
+	source := s.source + input + "\n"
+	start := parser.Position{Offset: len(s.source), Line: strings.Count(s.source, "\n") + 1}
+
+	program, err := parser.Parse(source)
+	if err != nil {
+		report(errOut, err, source, start)
+		return
+	}
+	program.Statements = withoutReplacedDefs(program.Statements, start)
+
+	// The statements of the input follow the defs of earlier inputs
+	first := 0
+	for first < len(program.Statements) && program.Statements[first].Pos().Offset < start.Offset {
+		first++
+	}
+	var checked parser.Program
+	for _, stmt := range program.Statements[:first] {
+		if _, ok := stmt.(*parser.FunctionDefinition); ok {
+			checked.Statements = append(checked.Statements, stmt)
+		}
+	}
+	ran := len(checked.Statements)
+	checked.Statements = append(checked.Statements, program.Statements[first:]...)
+
+	globals := map[string]*transpiler.Type{}
+	for _, name := range s.interpreter.Globals() {
+		value, _ := s.interpreter.Global(name)
+		globals[name] = interp.TypeOf(value)
+	}
+	info, err := transpiler.CheckWithGlobals(&checked, globals)
+	if err != nil {
+		report(errOut, err, source, start)
+		return
+	}
+
+	for i, stmt := range checked.Statements[ran:] {
+		checked.Statements[ran+i] = printValue(stmt, info)
+		program.Statements[first+i] = checked.Statements[ran+i]
+	}
+
+	s.source, s.program, s.start = source, program, start
+	if err := s.interpreter.RunFrom(&checked, info, ran); err != nil {
+		report(errOut, err, source, start)
+	}
+}
+
+// withoutReplacedDefs leaves out the defs of inputs before start that a
+// later def of the same name replaces. Defs of the same name within the
+// input at start are kept, to be reported.
+func withoutReplacedDefs(stmts []parser.Statement, start parser.Position) []parser.Statement {
+	defined := map[string]bool{}
+	kept := make([]parser.Statement, len(stmts))
+	n := len(stmts)
+	for i := len(stmts) - 1; i >= 0; i-- {
+		if def, ok := stmts[i].(*parser.FunctionDefinition); ok {
+			if defined[def.Name] && def.Pos().Offset < start.Offset {
+				continue
+			}
+			defined[def.Name] = true
+		}
+		n--
+		kept[n] = stmts[i]
+	}
+	return kept[n:]
+}
+
+// printValue turns a statement that is an expression with a value into a
+// print statement, so that typing an expression shows its value
+func printValue(stmt parser.Statement, info *transpiler.Info) parser.Statement {
+	expr, ok := stmt.(*parser.ExpressionStatement)
+	if !ok {
+		return stmt
+	}
+	if call, ok := expr.Expression.(*parser.CallExpression); ok {
+		switch f := call.Function.(type) {
+		case *parser.Identifier:
+			if _, result, ok := info.Function(f.Value); ok && result == nil {
+				return stmt
+			}
+		case *parser.MemberExpression:
+			if f.Name == "append" {
+				return stmt
+			}
+		}
+	}
+	return &parser.PrintStatement{Span: expr.Span, Arguments: []parser.Expression{expr.Expression}}
+}
+
+// report prints the diagnostics of a failed input. Those about the input
+// itself are placed at its own lines rather than lines of the session.
+func report(out io.Writer, err error, source string, start parser.Position) {
+	var diagnostics parser.Diagnostics
+	if !errors.As(err, &diagnostics) {
+		fmt.Fprintln(out, err)
+		return
+	}
+
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Span.From.Offset < start.Offset {
+			fmt.Fprint(out, diagnostic.Render(replFile, source))
+			continue
+		}
+		for _, pos := range []*parser.Position{&diagnostic.Span.From, &diagnostic.Span.To} {
+			pos.Offset -= start.Offset
+			pos.Line -= start.Line - 1
+		}
+		fmt.Fprint(out, diagnostic.Render(replFile, source[start.Offset:]))
+	}
+}
+
+// goCode returns the Go code generated for the last input: the functions
+// it defines and its statements of the main function. It is cut out of
+// the Go code of the whole session using the //line directives, which
+// give the klo line of each Go declaration and statement.
+func (s *session) goCode() (string, error) {
+	if s.program == nil {
+		return "", errors.New("nothing has been run yet")
+	}
+	result, err := transpiler.TranspileFile(s.program, replFile)
+	if err != nil {
+		var diagnostics parser.Diagnostics
+		if errors.As(err, &diagnostics) {
+			return "", fmt.Errorf("the last input has no Go translation: %s", diagnostics[0].Message)
+		}
+		return "", err
+	}
+
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, replFile+".go", result.Code, goparser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	fromInput := func(node ast.Node) bool {
+		return fset.Position(node.Pos()).Line >= s.start.Line
+	}
+	text := func(node ast.Node) string {
+		from, to := fset.Position(node.Pos()).Offset, fset.Position(node.End()).Offset
+		return withoutDirectives(result.Code[from:to])
+	}
+
+	var functions, statements []string
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		switch {
+		case !ok:
+		case fn.Name.Name == "main":
+			for _, stmt := range fn.Body.List {
+				if fromInput(stmt) {
+					// Lines after the first are indented for the body
+					// of main
+					statements = append(statements, strings.ReplaceAll(text(stmt), "\n\t", "\n"))
+				}
+			}
+		case fn.Doc != nil && strings.HasPrefix(fn.Doc.List[len(fn.Doc.List)-1].Text, "//line ") && fromInput(fn):
+			// Helpers the generator adds have no //line directive
+			functions = append(functions, text(fn))
+		}
+	}
+
+	var code strings.Builder
+	for _, function := range functions {
+		code.WriteString(function + "\n\n")
+	}
+	for _, statement := range statements {
+		code.WriteString(statement + "\n")
+	}
+	return code.String(), nil
+}
+
+// withoutDirectives removes the //line directives from Go code
+func withoutDirectives(code string) string {
+	lines := strings.Split(code, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "//line ") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
@@ -0,0 +1,502 @@
+package transpiler
+
+import (
+	"fmt"
+
+	"github.com/singleservingfriend/klo/parser"
+)
+
+// checkTypes infers the types of a program, records the type of every
+// expression, and reports operations that have no meaning for the types
+// involved. Operands whose type could not be inferred are not checked.
+// globals gives the types of variables defined outside the program.
+func checkTypes(program *parser.Program, globals map[string]*Type) (*typeInfo, parser.Diagnostics) {
+	c := &checker{info: inferTypes(program, globals)}
+
+	for _, stmt := range program.Statements {
+		if def, ok := stmt.(*parser.FunctionDefinition); ok {
+			c.fn = c.info.functions[def.Name]
+			if c.fn.def != def {
+				c.report(parser.Errorf(parser.SpanOf(def), parser.CodeRedefined,
+					"function %s is already defined at line %d", def.Name, c.fn.def.Pos().Line))
+				c.fn = nil
+				continue
+			}
+			c.checkBlock(def.Body)
+			c.fn = nil
+		} else {
+			c.checkStatement(stmt)
+		}
+	}
+
+	return c.info, c.errors
+}
+
+type checker struct {
+	info      *typeInfo
+	fn        *functionInfo     // function being checked, nil in the main program
+	discarded parser.Expression // expression of the expression statement being checked
+	errors    parser.Diagnostics
+}
+
+// errorAt returns a type error about an expression
+func (c *checker) errorAt(expr parser.Expression, format string, args ...any) parser.Diagnostic {
+	return parser.Errorf(parser.SpanOf(expr), parser.CodeType, format, args...)
+}
+
+func (c *checker) report(diagnostic parser.Diagnostic) {
+	c.errors = append(c.errors, diagnostic)
+}
+
+func (c *checker) errorf(expr parser.Expression, format string, args ...any) {
+	c.report(c.errorAt(expr, format, args...))
+}
+
+func (c *checker) scope() map[string]*Type {
+	if c.fn != nil {
+		return c.fn.locals
+	}
+	return c.info.globals
+}
+
+func (c *checker) checkBlock(stmts []parser.Statement) {
+	for _, stmt := range stmts {
+		c.checkStatement(stmt)
+	}
+}
+
+func (c *checker) checkStatement(stmt parser.Statement) {
+	switch s := stmt.(type) {
+	case *parser.AssignmentStatement:
+		c.checkValue(s.Value, c.variable(s.Name), s.Name)
+	case *parser.IndexAssignmentStatement:
+		object := c.check(s.Target.Object)
+		if object.Kind == String {
+			c.errorf(s.Target, "str does not support item assignment")
+			return
+		}
+		c.checkValue(s.Value, c.check(s.Target), s.Target.String())
+	case *parser.DeleteStatement:
+		switch object := c.check(s.Target.Object); object.Kind {
+		case List, Map, Unknown:
+			c.check(s.Target)
+		default:
+			c.errorf(s.Target, "cannot delete elements of %s", object)
+		}
+	case *parser.PrintStatement:
+		for _, arg := range s.Arguments {
+			c.check(arg)
+		}
+	case *parser.ExpressionStatement:
+		c.checkExpressionStatement(s)
+	case *parser.IfStatement:
+		for _, branch := range s.Branches {
+			c.check(branch.Condition)
+			c.checkBlock(branch.Body)
+		}
+		c.checkBlock(s.Else)
+	case *parser.WhileStatement:
+		c.check(s.Condition)
+		c.checkBlock(s.Body)
+	case *parser.ForStatement:
+		if it := c.info.iterationOf(s, c.scope()); it.problem != "" {
+			c.errorf(s.Iterable, "for loop over %s: %s", s.Iterable, it.problem)
+		} else {
+			c.check(it.subject)
+		}
+		c.info.inLoop(s, c.scope(), func() { c.checkBlock(s.Body) })
+	case *parser.ReturnStatement:
+		if s.Value != nil {
+			c.checkValue(s.Value, c.fn.result, "return value")
+		}
+	}
+}
+
+// checkExpressionStatement checks an expression whose value is unused,
+// which is where xs.append(v) is allowed
+func (c *checker) checkExpressionStatement(stmt *parser.ExpressionStatement) {
+	c.discarded = stmt.Expression
+	defer func() { c.discarded = nil }()
+
+	call, ok := stmt.Expression.(*parser.CallExpression)
+	if !ok {
+		c.check(stmt.Expression)
+		return
+	}
+	member, ok := call.Function.(*parser.MemberExpression)
+	if !ok || member.Name != "append" {
+		c.check(stmt.Expression)
+		return
+	}
+
+	list := c.check(member.Object)
+	if list.Kind != List && list.Kind != Unknown {
+		c.errorf(member, "%s has no method append", list)
+		return
+	}
+	if len(call.Arguments) != 1 {
+		c.errorf(call, "append() takes exactly one argument (%d given)", len(call.Arguments))
+		return
+	}
+	c.checkValue(call.Arguments[0], list.elem(), member.Object.String()+" element")
+}
+
+// variable returns the type of a variable as seen from the current scope
+func (c *checker) variable(name string) *Type {
+	if t, ok := c.scope()[name]; ok {
+		return t
+	}
+	return c.info.globals[name]
+}
+
+// checkValue checks an expression that is stored in a location of type
+// target, described by what
+func (c *checker) checkValue(expr parser.Expression, target *Type, what string) {
+	value := c.check(expr)
+	if !c.assignable(expr, value, target) {
+		c.errorf(expr, "cannot assign %s to %s of type %s", value, what, target)
+	}
+}
+
+// assignable reports whether the generator can store expr, of type value,
+// in a location of type target. Ints are converted to floats, and list
+// and dict literals take the type of their destination.
+func (c *checker) assignable(expr parser.Expression, value, target *Type) bool {
+	switch {
+	case target == nil || target.Kind == Unknown || value.Kind == Unknown:
+		return true
+	case target.Kind == Any:
+		return value.Kind != Function
+	case value.Kind == Int && target.Kind == Float:
+		return true
+	}
+
+	switch e := expr.(type) {
+	case *parser.ListLiteral:
+		if target.Kind != List {
+			return false
+		}
+		for _, elem := range e.Elements {
+			if !c.assignable(elem, c.info.exprs[elem], target.elem()) {
+				return false
+			}
+		}
+		return true
+	case *parser.DictLiteral:
+		if target.Kind != Map {
+			return false
+		}
+		for _, entry := range e.Entries {
+			if !c.assignable(entry.Key, c.info.exprs[entry.Key], target.key()) ||
+				!c.assignable(entry.Value, c.info.exprs[entry.Value], target.elem()) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return value.GoType() == target.GoType()
+}
+
+// check checks an expression and its operands, records its type and
+// returns it
+func (c *checker) check(expr parser.Expression) *Type {
+	switch e := expr.(type) {
+	case *parser.Identifier:
+		c.checkIdentifier(e)
+	case *parser.UnaryExpression:
+		operand := c.check(e.Operand)
+		if e.Operator != "not" && !operand.isNumeric() && operand.Kind != Unknown {
+			c.errorf(e, "bad operand type for unary %s: %s", e.Operator, operand)
+		}
+	case *parser.BinaryExpression:
+		c.checkBinary(e)
+	case *parser.CallExpression:
+		c.checkCall(e)
+	case *parser.MemberExpression:
+		c.check(e.Object)
+		c.report(c.errorAt(e, "%s must be called", e).WithSuggestion("call it as %s()", e))
+	case *parser.IndexExpression:
+		c.checkIndex(e)
+	case *parser.ListLiteral:
+		for _, elem := range e.Elements {
+			c.check(elem)
+		}
+	case *parser.DictLiteral:
+		for _, entry := range e.Entries {
+			if key := c.check(entry.Key); key.Kind == List || key.Kind == Map {
+				c.errorf(entry.Key, "unhashable type: %s", key)
+			}
+			c.check(entry.Value)
+		}
+	case *parser.RangeExpression:
+		for _, arg := range []parser.Expression{e.Start, e.Stop, e.Step} {
+			if arg == nil {
+				continue
+			}
+			if t := c.check(arg); t.Kind != Int && t.Kind != Unknown {
+				c.errorf(arg, "range() arguments must be int, not %s", t)
+			}
+		}
+		if sign, constant := constantSign(e.Step); constant && sign == 0 {
+			c.errorf(e.Step, "range() step must not be zero")
+		}
+	case *parser.InterpolatedString:
+		for _, part := range e.Parts {
+			if part.Value != nil {
+				c.checkFormat(part)
+			}
+		}
+	}
+
+	t := c.info.typeOf(expr, c.scope())
+	c.info.exprs[expr] = t
+	return t
+}
+
+func (c *checker) checkIdentifier(ident *parser.Identifier) {
+	t, variable := c.scope()[ident.Value]
+	if !variable {
+		t, variable = c.info.globals[ident.Value]
+	}
+	_, defined := c.info.functions[ident.Value]
+	switch {
+	case variable && (t == nil || t.Kind != Function):
+	case variable || defined || isBuiltin(ident.Value):
+		c.report(c.errorAt(ident, "function %s cannot be used as a value", ident.Value).
+			WithSuggestion("call it as %s(...)", ident.Value))
+	default:
+		c.report(c.undefined(ident))
+	}
+}
+
+// undefined returns the error about a name that is neither a variable nor
+// a function
+func (c *checker) undefined(ident *parser.Identifier) parser.Diagnostic {
+	return parser.Errorf(parser.SpanOf(ident), parser.CodeUndefined, "name '%s' is not defined", ident.Value)
+}
+
+// isBuiltin reports whether a function can be called without being
+// defined
+func isBuiltin(name string) bool {
+	return name == "len" || name == "enumerate" || name == "range"
+}
+
+// checkFormat checks a replacement field of an f-string and its format spec
+func (c *checker) checkFormat(part parser.InterpolationPart) {
+	t := c.check(part.Value)
+	spec, err := parseFormatSpec(part.Spec)
+	if err != nil {
+		c.report(parser.Errorf(part.Span, parser.CodeSyntax, "%s", err))
+		return
+	}
+	if _, _, err := spec.verb(t); err != nil {
+		c.report(parser.Errorf(part.Span, parser.CodeType, "%s", err))
+	}
+}
+
+func (c *checker) checkBinary(expr *parser.BinaryExpression) {
+	left := c.check(expr.Left)
+	right := c.check(expr.Right)
+	if left.Kind == Unknown || right.Kind == Unknown {
+		return
+	}
+
+	switch expr.Operator {
+	case "and", "or":
+		return
+	case "in", "not in":
+		c.checkMembership(expr, left, right)
+		return
+	case "==", "!=":
+		c.checkEquality(expr, left, right)
+		return
+	}
+
+	switch {
+	case left.isNumeric() && right.isNumeric():
+		return
+	case expr.Operator == "+" && left.Kind == String && right.Kind != Function:
+		if right.Kind != List && right.Kind != Map {
+			return
+		}
+	case expr.Operator == "+" && right.Kind == String && left.Kind != Function:
+		if left.Kind != List && left.Kind != Map {
+			return
+		}
+	case expr.Operator == "*" && (left.Kind == String && right.Kind == Int || left.Kind == Int && right.Kind == String):
+		return
+	case isComparison(expr.Operator) && left.Kind == String && right.Kind == String:
+		return
+	}
+
+	if isComparison(expr.Operator) {
+		c.errorf(expr, "'%s' is not supported between %s and %s", expr.Operator, left, right)
+	} else {
+		c.errorf(expr, "unsupported operand types for %s: %s and %s", expr.Operator, left, right)
+	}
+}
+
+// plural formats a count of things, as in "1 argument" or "2 arguments"
+func plural(n int, thing string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, thing)
+	}
+	return fmt.Sprintf("%d %ss", n, thing)
+}
+
+func isComparison(operator string) bool {
+	switch operator {
+	case "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+func (c *checker) checkEquality(expr *parser.BinaryExpression, left, right *Type) {
+	_, leftNone := expr.Left.(*parser.NoneLiteral)
+	_, rightNone := expr.Right.(*parser.NoneLiteral)
+	switch {
+	case leftNone && rightNone:
+		return
+	case leftNone || rightNone:
+		other := left
+		if leftNone {
+			other = right
+		}
+		if other.Kind != Any {
+			c.errorf(expr, "a value of type %s is never None", other)
+		}
+		return
+	}
+
+	switch {
+	case left.Kind == Function || right.Kind == Function:
+	case left.isNumeric() && right.isNumeric():
+		return
+	case left.Kind == Any && right.Kind != List && right.Kind != Map:
+		return
+	case right.Kind == Any && left.Kind != List && left.Kind != Map:
+		return
+	case left.GoType() == right.GoType():
+		return
+	}
+	c.errorf(expr, "cannot compare %s with %s", left, right)
+}
+
+func (c *checker) checkMembership(expr *parser.BinaryExpression, left, right *Type) {
+	switch right.Kind {
+	case String:
+		if left.Kind != String {
+			c.errorf(expr, "'in <str>' requires str as left operand, not %s", left)
+		}
+	case List:
+		if !c.assignable(expr.Left, left, right.elem()) {
+			c.errorf(expr, "cannot look for %s in %s", left, right)
+		}
+	case Map:
+		if !c.assignable(expr.Left, left, right.key()) {
+			c.errorf(expr, "cannot look for %s in %s", left, right)
+		}
+	default:
+		c.errorf(expr.Right, "argument of type %s is not iterable", right)
+	}
+}
+
+func (c *checker) checkIndex(expr *parser.IndexExpression) {
+	object := c.check(expr.Object)
+	index := c.check(expr.Index)
+
+	switch object.Kind {
+	case Unknown:
+	case List, String:
+		if index.Kind != Int && index.Kind != Unknown {
+			c.errorf(expr.Index, "%s indices must be int, not %s", object, index)
+		}
+	case Map:
+		if !c.assignable(expr.Index, index, object.key()) {
+			c.errorf(expr.Index, "cannot use %s as a key of %s", index, object)
+		}
+	default:
+		c.errorf(expr, "%s is not subscriptable", object)
+	}
+}
+
+func (c *checker) checkCall(call *parser.CallExpression) {
+	for _, arg := range call.Arguments {
+		c.check(arg)
+	}
+
+	switch callee := call.Function.(type) {
+	case *parser.Identifier:
+		c.checkFunctionCall(callee, call)
+	case *parser.MemberExpression:
+		object := c.check(callee.Object)
+		switch {
+		case callee.Name == "append" && object.Kind == List:
+			c.report(c.errorAt(call, "append() does not return a value").
+				WithSuggestion("use it as a statement, as in %s.append(x)", callee.Object))
+		case callee.Name == "items" && object.Kind == Map:
+			c.report(c.errorAt(call, "items() can only be used in a for loop").
+				WithSuggestion("loop over it, as in: for key, value in %s.items()", callee.Object))
+		case object.Kind != Unknown:
+			c.errorf(callee, "%s has no method %s", object, callee.Name)
+		}
+	default:
+		c.errorf(call.Function, "%s is not callable", c.check(call.Function))
+	}
+}
+
+func (c *checker) checkFunctionCall(callee *parser.Identifier, call *parser.CallExpression) {
+	name := callee.Value
+	if t, ok := c.scope()[name]; ok && (t == nil || t.Kind != Function) {
+		c.errorf(call.Function, "%s is not callable", c.variable(name))
+		return
+	}
+
+	if fn, ok := c.info.functions[name]; ok {
+		if len(call.Arguments) != len(fn.params) {
+			c.report(c.errorAt(call, "%s() takes %s, got %d", name, plural(len(fn.params), "argument"), len(call.Arguments)).
+				WithNote("%s() is defined at line %d", name, fn.def.Pos().Line))
+			return
+		}
+		for i, arg := range call.Arguments {
+			if !c.assignable(arg, c.info.exprs[arg], fn.params[i]) {
+				c.errorf(arg, "cannot pass %s as argument %d of %s(), which takes %s",
+					c.info.exprs[arg], i+1, name, fn.params[i])
+			}
+		}
+		// Only a call that is a statement of its own can do without a value
+		if fn.result == nil && call != c.discarded {
+			c.report(c.errorAt(call, "function '%s' does not return a value", name).
+				WithNote("%s() is defined at line %d", name, fn.def.Pos().Line))
+		}
+		return
+	}
+
+	switch name {
+	case "len":
+		if len(call.Arguments) != 1 {
+			c.errorf(call, "len() takes exactly one argument (%d given)", len(call.Arguments))
+			return
+		}
+		switch arg := c.info.exprs[call.Arguments[0]]; arg.Kind {
+		case String, List, Map, Unknown:
+		default:
+			c.errorf(call.Arguments[0], "object of type %s has no len()", arg)
+		}
+	case "enumerate":
+		c.report(c.errorAt(call, "enumerate() can only be used in a for loop").
+			WithSuggestion("loop over it, as in: for i, x in enumerate(xs)"))
+	default:
+		// Functions of the application embedding klo are globals of kind
+		// Function, which take any arguments
+		t, ok := c.info.globals[name]
+		switch {
+		case !ok:
+			c.report(c.undefined(callee))
+		case t == nil || t.Kind != Function:
+			c.errorf(call.Function, "%s is not callable", t)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package transpiler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// formatSpec is a parsed format spec of an f-string replacement field, as
+// in {price:>8.2f}. It follows Python's mini-language,
+// [[fill]align][sign][#][0][width][.precision][type], without the parts
+// Go's fmt package has no equivalent for.
+type formatSpec struct {
+	align     byte // '<', '>' or '=', 0 when not given
+	sign      byte // '+' or ' ', 0 when not given
+	alternate bool // '#'
+	zero      bool // '0', or a '0' fill
+	width     string
+	precision string // digits after the '.', "" when not given
+	kind      byte   // presentation type such as 'f' or 'd', 0 when not given
+}
+
+// parseFormatSpec parses the text after the ':' of a replacement field
+func parseFormatSpec(spec string) (formatSpec, error) {
+	var s formatSpec
+	rest := spec
+
+	isAlign := func(ch byte) bool { return strings.IndexByte("<>=^", ch) >= 0 }
+	switch {
+	case len(rest) >= 2 && isAlign(rest[1]):
+		switch fill := rest[0]; {
+		case fill == '0':
+			s.zero = true
+		case fill != ' ':
+			return s, fmt.Errorf("fill character '%c' is not supported; values can only be padded with spaces or zeros", fill)
+		}
+		s.align, rest = rest[1], rest[2:]
+	case len(rest) >= 1 && isAlign(rest[0]):
+		s.align, rest = rest[0], rest[1:]
+	}
+	if s.align == '^' {
+		return s, fmt.Errorf("centered alignment with '^' is not supported")
+	}
+
+	if rest != "" && (rest[0] == '+' || rest[0] == '-' || rest[0] == ' ') {
+		if rest[0] != '-' {
+			s.sign = rest[0]
+		}
+		rest = rest[1:]
+	}
+	if strings.HasPrefix(rest, "#") {
+		s.alternate, rest = true, rest[1:]
+	}
+	if strings.HasPrefix(rest, "0") {
+		s.zero, rest = true, rest[1:]
+	}
+
+	s.width, rest = leadingDigits(rest)
+	if rest != "" && (rest[0] == ',' || rest[0] == '_') {
+		return s, fmt.Errorf("digit grouping with '%c' is not supported", rest[0])
+	}
+	if strings.HasPrefix(rest, ".") {
+		s.precision, rest = leadingDigits(rest[1:])
+		if s.precision == "" {
+			return s, fmt.Errorf("format spec '%s' has a '.' without a precision", spec)
+		}
+	}
+
+	switch {
+	case len(rest) == 1 && strings.IndexByte("bdoxXeEfFgG%s", rest[0]) >= 0:
+		s.kind = rest[0]
+	case len(rest) == 1 && (rest[0] == 'c' || rest[0] == 'n'):
+		return s, fmt.Errorf("format code '%c' is not supported", rest[0])
+	case rest != "":
+		return s, fmt.Errorf("invalid format spec '%s'", spec)
+	}
+
+	if s.align == '=' && !s.zero {
+		return s, fmt.Errorf("alignment '=' is only supported with a '0' fill")
+	}
+	if s.align == '<' && s.zero {
+		return s, fmt.Errorf("a '0' fill is only supported for values aligned right")
+	}
+	return s, nil
+}
+
+func leadingDigits(s string) (digits, rest string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// verb returns the Go fmt verb that formats a value of type t as the spec
+// asks, and whether the value has to be converted to float64 first. A
+// spec that does not apply to the type is an error, as in Python.
+func (s formatSpec) verb(t *Type) (verb string, toFloat bool, err error) {
+	number := t.isNumeric() || t.Kind == Any || t.Kind == Unknown
+	integer := t.Kind == Int || t.Kind == Any || t.Kind == Unknown
+	text := t.Kind == String || t.Kind == Any || t.Kind == Unknown
+
+	kind := s.kind
+	switch kind {
+	case 0:
+		switch {
+		case t.Kind == String:
+			kind = 's'
+		case t.Kind == Int:
+			if s.precision != "" {
+				return "", false, fmt.Errorf("precision is not allowed when formatting int")
+			}
+			kind = 'd'
+		case t.Kind == Float && s.precision != "":
+			kind = 'g'
+		default:
+			if s.precision != "" {
+				return "", false, fmt.Errorf("precision is not allowed when formatting %s", t)
+			}
+			kind = 'v'
+		}
+	case 'd', 'b', 'o', 'x', 'X':
+		if !integer {
+			return "", false, fmt.Errorf("format code '%c' needs an int, got %s", kind, t)
+		}
+		if s.precision != "" {
+			return "", false, fmt.Errorf("precision is not allowed with format code '%c'", kind)
+		}
+	case 'e', 'E', 'f', 'F', 'g', 'G', '%':
+		// Percentages are scaled in Go, which needs a static number type
+		if !number || kind == '%' && !t.isNumeric() {
+			return "", false, fmt.Errorf("format code '%c' needs a number, got %s", kind, t)
+		}
+		toFloat = t.Kind == Int
+	case 's':
+		if !text {
+			return "", false, fmt.Errorf("format code 's' needs a str, got %s", t)
+		}
+	}
+	if s.zero && (kind == 's' || kind == 'v' && !t.isNumeric()) {
+		return "", false, fmt.Errorf("zero padding needs a number, got %s", t)
+	}
+
+	var flags strings.Builder
+	// Strings are aligned left unless the spec says otherwise, as in
+	// Python, while Go aligns everything right
+	if s.align == '<' || s.align == 0 && s.width != "" && t.Kind == String {
+		flags.WriteByte('-')
+	}
+	if s.sign != 0 {
+		flags.WriteByte(s.sign)
+	}
+	// Python's '#o' prefix is 0o, which Go writes with %O
+	if s.alternate && kind == 'o' {
+		kind = 'O'
+	} else if s.alternate {
+		flags.WriteByte('#')
+	}
+	if s.zero && s.align != '<' {
+		flags.WriteByte('0')
+	}
+
+	// Python's general format defaults to 6 significant digits, while Go's
+	// uses as many as needed
+	precision := s.precision
+	if precision == "" && (kind == 'g' || kind == 'G') {
+		precision = "6"
+	}
+
+	suffix := ""
+	if kind == '%' {
+		kind, suffix = 'f', "%%"
+	}
+
+	verb = "%" + flags.String() + s.width
+	if precision != "" {
+		verb += "." + precision
+	}
+	return verb + string(kind) + suffix, toFloat, nil
+}
+
+// percent reports whether a format spec multiplies its value by 100
+func (s formatSpec) percent() bool {
+	return s.kind == '%'
+}
+
+// FormatVerb returns the Go fmt verb that formats a value of type t as
+// the format spec of an f-string replacement field asks, whether the
+// value has to be converted to float64 first, and whether it has to be
+// multiplied by 100, as a percentage is
+func FormatVerb(spec string, t *Type) (verb string, toFloat, percent bool, err error) {
+	s, err := parseFormatSpec(spec)
+	if err != nil {
+		return "", false, false, err
+	}
+	verb, toFloat, err = s.verb(t)
+	return verb, toFloat, s.percent(), err
+}
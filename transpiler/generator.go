@@ -1,194 +1,1162 @@
 package transpiler
 
 import (
+	"bytes"
 	"fmt"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+
 	"github.com/singleservingfriend/klo/parser"
 )
 
-// GenerateGoCode converts a klo AST to Go source code
-func GenerateGoCode(program *parser.Program) string {
+// Result is the output of Transpile. Warnings are problems that do not
+// stop the program from being transpiled, such as a variable that is
+// never used.
+type Result struct {
+	Code      string
+	Warnings  []parser.Diagnostic
+	SourceMap *SourceMap
+}
+
+// Transpile converts a klo AST to Go source code. The program is type
+// checked first; Transpile fails with parser.Diagnostics on type errors
+// and when the program uses a construct that has no Go translation.
+func Transpile(program *parser.Program) (*Result, error) {
+	return TranspileFile(program, "")
+}
+
+// TranspileFile is Transpile for a program read from filename. The Go code
+// carries //line directives naming filename, so that Go compiler errors,
+// panics and stack traces point at the klo source. The name is written as
+// given, and the Go toolchain resolves a relative name against the
+// directory of the Go file.
+func TranspileFile(program *parser.Program, filename string) (*Result, error) {
+	info, err := Check(program)
+	if err != nil {
+		return nil, err
+	}
+
 	generator := &GoGenerator{
-		indent: 0,
+		types:    info.types,
+		scopes:   info.scopes,
+		imports:  map[string]bool{},
+		helpers:  map[string]bool{},
+		names:    mangleNames(program),
+		warnings: slices.Clip(info.Warnings),
+		filename: filename,
+		fset:     token.NewFileSet(),
+	}
+
+	code := generator.generateProgram(program)
+	if len(generator.errors) > 0 {
+		return nil, generator.errors
 	}
-	
-	return generator.generateProgram(program)
+
+	sort.SliceStable(generator.warnings, func(i, j int) bool {
+		return generator.warnings[i].Span.From.Offset < generator.warnings[j].Span.From.Offset
+	})
+	return &Result{Code: code, Warnings: generator.warnings, SourceMap: newSourceMap(code)}, nil
+}
+
+// GenerateGoCode converts a klo AST to Go source code, discarding warnings
+func GenerateGoCode(program *parser.Program) (string, error) {
+	result, err := Transpile(program)
+	if err != nil {
+		return "", err
+	}
+	return result.Code, nil
 }
 
-// GoGenerator handles the conversion from AST to Go code
+// GoGenerator handles the conversion from AST to Go code. It builds a Go
+// syntax tree, which go/printer lays out the way gofmt does.
 type GoGenerator struct {
-	indent int
+	types    *typeInfo
+	scopes   *scopeInfo
+	function *functionInfo     // function being generated, nil inside main
+	imports  map[string]bool   // packages used by the generated code
+	helpers  map[string]bool   // helper functions used by the generated code
+	names    map[string]string // klo names that are renamed in Go
+	errors   parser.Diagnostics
+	warnings []parser.Diagnostic
+	filename string                    // klo file named in //line directives, if any
+	fset     *token.FileSet            // positions of the Go syntax tree
+	file     *token.File               // the lines of the Go file, laid out by layOut
+	base     int                       // line of file that klo line 0 of the declaration being generated is on
+	lines    []int                     // line of each klo line relative to base
+	ownLine  map[parser.Statement]bool // statements on the line after their klo line, set by layOut
+	comments []*ast.CommentGroup       // comments of the Go file, including //line directives
+}
+
+// lineWidth is the size of a line of the Go file in positions. go/printer
+// estimates the position of a token that has none from the text printed
+// since the last token that has one, and places comments by comparing
+// positions, so a line has room for far more code than a statement prints
+// as.
+const lineWidth = 1 << 16
+
+// layOut adds the lines of the Go file to fset and places its
+// declarations on them: first the helper functions, on their lines of
+// helperSource, then the header of renamed names and package-level
+// variables, then each function on as many lines as it has in the klo
+// program, and last main, on the lines of the whole program. An empty line
+// separates them. Statements go on the line of the klo statement they are
+// generated from, one position past the start of the line, where its
+// //line directive goes. A statement that starts a body on the line of
+// its header, as in if x: print x, gets the line after it, which klo
+// lines take one more line to make room for. A simple statement prints on
+// one line, so the klo lines it continues onto, as in a triple-quoted
+// string, take none.
+func (g *GoGenerator) layOut(program *parser.Program, headerLines int) (header int, bases map[*parser.FunctionDefinition]int, main int) {
+	lastLine := 0
+	for _, stmt := range program.Statements {
+		lastLine = max(lastLine, stmt.End().Line)
+	}
+	g.ownLine = map[parser.Statement]bool{}
+	continued := map[int]bool{}
+	findOwnLines(program.Statements, 0, g.ownLine, continued)
+	shared := map[int]bool{}
+	for stmt := range g.ownLine {
+		shared[stmt.Pos().Line] = true
+	}
+	// The closing brace of a body goes on the line after it
+	g.lines = make([]int, lastLine+2)
+	for line := 1; line < len(g.lines); line++ {
+		g.lines[line] = g.lines[line-1]
+		if !continued[line] {
+			g.lines[line]++
+		}
+		if shared[line-1] {
+			g.lines[line]++
+		}
+	}
+
+	header = helperFile.LineCount() + 2
+	next := header
+	if headerLines > 0 {
+		next += headerLines + 1
+	}
+	bases = map[*parser.FunctionDefinition]int{}
+	for _, stmt := range program.Statements {
+		if def, ok := stmt.(*parser.FunctionDefinition); ok {
+			bases[def] = next - g.lines[def.Pos().Line]
+			next += g.lines[def.End().Line+1] - g.lines[def.Pos().Line] + 2
+		}
+	}
+	main = next
+	lines := main + g.lines[lastLine+1]
+
+	// The helpers keep their positions, so the file has the base of
+	// helperFile, the first file of its file set as well
+	offsets := helperFile.Lines()
+	for line := len(offsets); line < lines; line++ {
+		offsets = append(offsets, helperFile.Size()+(line-len(helperFile.Lines()))*lineWidth)
+	}
+	g.file = g.fset.AddFile(g.filename, helperFile.Base(), helperFile.Size()+(lines-helperFile.LineCount())*lineWidth)
+	g.file.SetLines(offsets)
+	return header, bases, main
+}
+
+// findOwnLines records the statements that start a body on the line of
+// the statement the body belongs to, header being that line, and the lines
+// that simple statements continue onto
+func findOwnLines(stmts []parser.Statement, header int, found map[parser.Statement]bool, continued map[int]bool) {
+	for i, stmt := range stmts {
+		if i == 0 && stmt.Pos().Line == header {
+			found[stmt] = true
+		}
+		switch s := stmt.(type) {
+		case *parser.IfStatement:
+			for _, branch := range s.Branches {
+				findOwnLines(branch.Body, branch.Pos().Line, found, continued)
+			}
+			findOwnLines(s.Else, s.ElsePos.Line, found, continued)
+		case *parser.ForStatement:
+			findOwnLines(s.Body, s.Pos().Line, found, continued)
+		case *parser.WhileStatement:
+			findOwnLines(s.Body, s.Pos().Line, found, continued)
+		case *parser.FunctionDefinition:
+			findOwnLines(s.Body, s.Pos().Line, found, continued)
+		default:
+			for line := stmt.Pos().Line + 1; line <= stmt.End().Line; line++ {
+				continued[line] = true
+			}
+		}
+	}
+}
+
+// errorf records a construct that cannot be translated
+func (g *GoGenerator) errorf(expr parser.Expression, format string, args ...any) {
+	g.errors = append(g.errors, parser.Errorf(parser.SpanOf(expr), parser.CodeUnsupported, format, args...))
+}
+
+// lineStart returns the position of the start of a line of the Go file
+func (g *GoGenerator) lineStart(line int) token.Pos {
+	if line < 1 || line > g.file.LineCount() {
+		return token.NoPos
+	}
+	return g.file.LineStart(line)
+}
+
+// line returns the line of the Go file that a klo line is on, in the
+// declaration being generated
+func (g *GoGenerator) line(kloLine int) int {
+	if kloLine < 1 || kloLine >= len(g.lines) {
+		return 0
+	}
+	return g.base + g.lines[kloLine]
+}
+
+// pos returns the Go position of the line of a klo position, in the
+// declaration being generated
+func (g *GoGenerator) pos(p parser.Position) token.Pos {
+	start := g.lineStart(g.line(p.Line))
+	if !start.IsValid() {
+		return token.NoPos
+	}
+	return start + 1
+}
+
+// lineDirective adds a //line directive at the start of a line of the Go
+// file, giving the klo line of the code on it, when the file name is
+// known. A directive that starts its line is not indented by go/printer.
+func (g *GoGenerator) lineDirective(line int, pos parser.Position) {
+	if g.filename == "" || pos.Line < 1 {
+		return
+	}
+	g.comments = append(g.comments, &ast.CommentGroup{List: []*ast.Comment{{
+		Slash: g.lineStart(line),
+		Text:  fmt.Sprintf("//line %s:%d", g.filename, pos.Line),
+	}}})
 }
 
 func (g *GoGenerator) generateProgram(program *parser.Program) string {
-	var output strings.Builder
-	
-	// Add package declaration and imports
-	output.WriteString("package main\n\n")
-	output.WriteString("import (\n")
-	output.WriteString("\t\"fmt\"\n")
-	output.WriteString(")\n\n")
-	
-	// Add main function
-	output.WriteString("func main() {\n")
-	g.indent++
-	
-	// Generate statements
+	renamings := g.renamings()
+	headerLines := len(g.scopes.globals)
+	if len(renamings) > 0 {
+		headerLines += len(renamings) + 2
+	}
+	header, bases, mainLine := g.layOut(program, headerLines)
+
+	// The original names of renamed variables and functions are kept for
+	// readers of the Go code
+	var decls []ast.Decl
+	line := header
+	if len(renamings) > 0 {
+		comments := &ast.CommentGroup{List: []*ast.Comment{{
+			Slash: g.lineStart(line),
+			Text:  "// klo names renamed to avoid clashing with Go:",
+		}}}
+		for _, r := range renamings {
+			line++
+			comments.List = append(comments.List, &ast.Comment{
+				Slash: g.lineStart(line),
+				Text:  fmt.Sprintf("//\t%s -> %s", r.klo, r.goName),
+			})
+		}
+		g.comments = append(g.comments, comments)
+		line += 2
+	}
+
+	// Variables shared between functions and the main program live at
+	// package level
+	for _, global := range g.scopes.globals {
+		decl := varDecl(g.name(global.name), global.typ.GoTypeExpr(), nil).Decl.(*ast.GenDecl)
+		decl.TokPos = g.lineStart(line) + 1
+		decls = append(decls, decl)
+		line++
+	}
+
+	// Functions become top-level Go functions, and the other statements
+	// the body of main
+	var statements []parser.Statement
 	for _, stmt := range program.Statements {
-		code := g.generateStatement(stmt)
-		if code != "" {
-			output.WriteString(g.indentString() + code + "\n")
+		if def, ok := stmt.(*parser.FunctionDefinition); ok {
+			g.base = bases[def]
+			g.lineDirective(g.line(def.Pos().Line), def.Pos())
+			decls = append(decls, g.generateFunctionDefinition(def))
+		} else {
+			statements = append(statements, stmt)
 		}
 	}
-	
-	g.indent--
-	output.WriteString("}\n")
-	
+
+	g.base = mainLine
+	main := &ast.FuncDecl{
+		Name: ident("main"),
+		Type: &ast.FuncType{Func: g.lineStart(mainLine) + 1, Params: &ast.FieldList{}},
+		Body: &ast.BlockStmt{List: g.generateBlock(statements)},
+	}
+	// The body starts right below the header, whatever the line of its
+	// first statement, so the brace ends the line before it. The closing
+	// brace goes on the line after the body, so that go/printer does not
+	// fold a short main onto one line.
+	main.Body.Lbrace, main.Body.Rbrace = main.Type.Func, g.lineStart(mainLine+1)
+	if n := len(statements); n > 0 {
+		main.Body.Lbrace = g.lineStart(g.line(statements[0].Pos().Line)) - 1
+		main.Body.Rbrace = g.lineStart(g.line(statements[n-1].End().Line + 1))
+	}
+	decls = append(decls, main)
+
+	// The import list is only known once the code has been generated
+	imports := make([]string, 0, len(g.imports))
+	for path := range g.imports {
+		imports = append(imports, path)
+	}
+	sort.Strings(imports)
+
+	file := &ast.File{Name: ident("main"), Comments: g.comments}
+	if len(imports) > 0 {
+		// A valid parenthesis position keeps a single import in a list
+		decl := &ast.GenDecl{Tok: token.IMPORT, Lparen: token.Pos(1)}
+		for _, path := range imports {
+			decl.Specs = append(decl.Specs, &ast.ImportSpec{Path: stringLit(path)})
+		}
+		file.Decls = append(file.Decls, decl)
+	}
+	file.Decls = append(file.Decls, g.generateHelpers()...)
+	file.Decls = append(file.Decls, decls...)
+	sort.SliceStable(file.Comments, func(i, j int) bool {
+		return file.Comments[i].Pos() < file.Comments[j].Pos()
+	})
+
+	config := printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+	var output bytes.Buffer
+	if err := config.Fprint(&output, g.fset, file); err != nil {
+		// The printer only fails on a malformed tree or a failing writer
+		panic(fmt.Sprintf("printing generated Go code: %v", err))
+	}
 	return output.String()
 }
 
-func (g *GoGenerator) generateStatement(stmt parser.Statement) string {
+// scope returns the variable types of the function being generated
+func (g *GoGenerator) scope() map[string]*Type {
+	if g.function != nil {
+		return g.function.locals
+	}
+	return g.types.globals
+}
+
+// variableType returns the inferred type of a variable, which may be a
+// package-level variable when generating a function
+func (g *GoGenerator) variableType(name string) *Type {
+	if t, ok := g.scope()[name]; ok {
+		return t
+	}
+	return g.types.globals[name]
+}
+
+// typeOf returns the inferred type of an expression in the current scope
+func (g *GoGenerator) typeOf(expr parser.Expression) *Type {
+	if t, ok := g.types.exprs[expr]; ok {
+		return t
+	}
+	return g.types.typeOf(expr, g.scope())
+}
+
+// generateBlock generates the statements of a block, preceded by the
+// variables declared ahead of them. The Go statements of each klo
+// statement are placed on its line.
+func (g *GoGenerator) generateBlock(stmts []parser.Statement) []ast.Stmt {
+	var list []ast.Stmt
+	for _, stmt := range stmts {
+		var code []ast.Stmt
+		for _, decl := range g.scopes.hoisted[stmt] {
+			code = append(code, varDecl(g.name(decl.name), decl.typ.GoTypeExpr(), nil))
+			if decl.unused {
+				code = append(code, assign(ident("_"), token.ASSIGN, ident(g.name(decl.name))))
+			}
+		}
+		code = append(code, g.generateStatement(stmt)...)
+		if len(code) == 0 {
+			continue
+		}
+		line := g.line(stmt.Pos().Line)
+		if g.ownLine[stmt] {
+			line++
+		}
+		for _, c := range code {
+			at(c, g.lineStart(line)+1)
+		}
+		g.lineDirective(line, stmt.Pos())
+		list = append(list, code...)
+	}
+	return list
+}
+
+func (g *GoGenerator) generateStatement(stmt parser.Statement) []ast.Stmt {
 	switch s := stmt.(type) {
 	case *parser.PrintStatement:
-		return g.generatePrintStatement(s)
+		return []ast.Stmt{g.generatePrintStatement(s)}
 	case *parser.AssignmentStatement:
 		return g.generateAssignmentStatement(s)
+	case *parser.IndexAssignmentStatement:
+		return []ast.Stmt{g.generateIndexAssignmentStatement(s)}
+	case *parser.DeleteStatement:
+		return []ast.Stmt{g.generateDeleteStatement(s)}
 	case *parser.IfStatement:
-		return g.generateIfStatement(s)
+		return []ast.Stmt{g.generateIfStatement(s)}
 	case *parser.ForStatement:
 		return g.generateForStatement(s)
+	case *parser.WhileStatement:
+		return []ast.Stmt{g.generateWhileStatement(s)}
+	case *parser.BreakStatement:
+		return []ast.Stmt{&ast.BranchStmt{Tok: token.BREAK}}
+	case *parser.ContinueStatement:
+		return []ast.Stmt{&ast.BranchStmt{Tok: token.CONTINUE}}
+	case *parser.ReturnStatement:
+		return []ast.Stmt{g.generateReturnStatement(s)}
 	case *parser.ExpressionStatement:
-		return g.generateExpression(s.Expression)
+		return []ast.Stmt{g.generateExpressionStatement(s)}
+	default:
+		g.errors = append(g.errors, parser.Errorf(parser.SpanOf(stmt), parser.CodeUnsupported,
+			"unsupported statement %T", stmt))
+		return nil
+	}
+}
+
+// generateRangeLoop generates a counting loop without its body. The loop
+// condition depends on the direction of the step: when the step is a
+// constant it is chosen here, otherwise it is checked at run time. As in
+// Python, a stop or step that is not a constant is evaluated once, before
+// the loop.
+func (g *GoGenerator) generateRangeLoop(variable string, rangeExpr *parser.RangeExpression) *ast.ForStmt {
+	if variable == "_" {
+		// The loop still needs a variable to count with
+		variable = loopCounter
+	}
+	start, stop, step := g.rangeBounds(rangeExpr)
+	init := &ast.AssignStmt{Lhs: []ast.Expr{ident(variable)}, Tok: token.DEFINE, Rhs: []ast.Expr{start}}
+	if _, constant := constantSign(rangeExpr.Stop); !constant {
+		init.Lhs, init.Rhs = append(init.Lhs, ident(loopStop)), append(init.Rhs, stop)
+		stop = ident(loopStop)
+	}
+	sign, constant := constantSign(rangeExpr.Step)
+	if rangeExpr.Step != nil && !constant {
+		init.Lhs, init.Rhs = append(init.Lhs, ident(loopStep)), append(init.Rhs, step)
+		step = ident(loopStep)
+	}
+	loop := &ast.ForStmt{Init: init}
+
+	switch {
+	case rangeExpr.Step == nil:
+		loop.Cond = binary(ident(variable), token.LSS, stop)
+		loop.Post = &ast.IncDecStmt{X: ident(variable), Tok: token.INC}
+	case constant && sign > 0:
+		loop.Cond = binary(ident(variable), token.LSS, stop)
+		loop.Post = assign(ident(variable), token.ADD_ASSIGN, step)
+	case constant && sign < 0:
+		loop.Cond = binary(ident(variable), token.GTR, stop)
+		loop.Post = assign(ident(variable), token.ADD_ASSIGN, step)
+	case constant:
+		g.errorf(rangeExpr.Step, "range() step must not be zero")
 	default:
-		return fmt.Sprintf("// Unknown statement: %T", stmt)
+		up := binary(binary(step, token.GTR, intLit(0)), token.LAND, binary(ident(variable), token.LSS, stop))
+		down := binary(binary(step, token.LSS, intLit(0)), token.LAND, binary(ident(variable), token.GTR, stop))
+		loop.Cond = binary(paren(up), token.LOR, paren(down))
+		loop.Post = assign(ident(variable), token.ADD_ASSIGN, step)
 	}
+
+	return loop
 }
 
-func (g *GoGenerator) generatePrintStatement(stmt *parser.PrintStatement) string {
-	if len(stmt.Arguments) == 0 {
-		return "fmt.Println()"
+// rangeBounds returns the Go start, stop and step of a range, filling in
+// the defaults for omitted arguments
+func (g *GoGenerator) rangeBounds(rangeExpr *parser.RangeExpression) (start, stop, step ast.Expr) {
+	start, step = intLit(0), intLit(1)
+	if rangeExpr.Start != nil {
+		start = g.generateExpression(rangeExpr.Start)
+	}
+	if rangeExpr.Step != nil {
+		step = g.generateExpression(rangeExpr.Step)
 	}
-	
-	args := make([]string, len(stmt.Arguments))
+	return start, g.generateExpression(rangeExpr.Stop), step
+}
+
+// constantSign reports the sign of a numeric literal expression, and
+// whether the expression is such a literal at all
+func constantSign(expr parser.Expression) (sign int, constant bool) {
+	if unary, ok := expr.(*parser.UnaryExpression); ok && unary.Operator != "not" {
+		sign, constant = constantSign(unary.Operand)
+		if unary.Operator == "-" {
+			sign = -sign
+		}
+		return sign, constant
+	}
+
+	number, ok := expr.(*parser.NumberLiteral)
+	if !ok {
+		return 0, false
+	}
+	if number.Int == 0 && number.Float == 0 {
+		return 0, true
+	}
+	return 1, true
+}
+
+func (g *GoGenerator) generateWhileStatement(stmt *parser.WhileStatement) *ast.ForStmt {
+	return &ast.ForStmt{
+		Cond: g.generateCondition(stmt.Condition),
+		Body: &ast.BlockStmt{List: g.generateBlock(stmt.Body)},
+	}
+}
+
+func (g *GoGenerator) generateFunctionDefinition(def *parser.FunctionDefinition) *ast.FuncDecl {
+	fn := g.types.functions[def.Name]
+	g.function = fn
+	defer func() { g.function = nil }()
+
+	params := &ast.FieldList{}
+	for i, param := range def.Parameters {
+		params.List = append(params.List, &ast.Field{
+			Names: []*ast.Ident{ident(g.name(param))},
+			Type:  fn.params[i].GoTypeExpr(),
+		})
+	}
+
+	decl := &ast.FuncDecl{
+		Name: ident(g.name(def.Name)),
+		Type: &ast.FuncType{Params: params},
+		Body: &ast.BlockStmt{List: g.generateBlock(def.Body)},
+	}
+	if fn.result != nil {
+		decl.Type.Results = &ast.FieldList{List: []*ast.Field{{Type: fn.result.GoTypeExpr()}}}
+	}
+	at(decl, g.pos(def.Pos()))
+	// The closing brace goes on the line after the body, so that go/printer
+	// does not fold a short function onto one line
+	decl.Body.Lbrace = g.pos(def.Pos())
+	decl.Body.Rbrace = g.pos(parser.Position{Line: def.End().Line + 1})
+
+	// Falling off the end of a klo function returns nothing, which Go
+	// only accepts for functions without a result
+	if fn.result != nil && !isTerminating(def.Body) {
+		decl.Body.List = append(decl.Body.List, &ast.ReturnStmt{Results: []ast.Expr{fn.result.ZeroValue()}})
+	}
+
+	return decl
+}
+
+func (g *GoGenerator) generateReturnStatement(stmt *parser.ReturnStatement) *ast.ReturnStmt {
+	if stmt.Value != nil {
+		var result *Type
+		if g.function != nil {
+			result = g.function.result
+		}
+		return &ast.ReturnStmt{Results: []ast.Expr{g.generateValue(stmt.Value, result)}}
+	}
+
+	if g.function != nil && g.function.result != nil {
+		return &ast.ReturnStmt{Results: []ast.Expr{g.function.result.ZeroValue()}}
+	}
+
+	return &ast.ReturnStmt{}
+}
+
+// isTerminating reports whether a block always ends in a return, using
+// the same rules as the Go specification's terminating statements
+func isTerminating(stmts []parser.Statement) bool {
+	if len(stmts) == 0 {
+		return false
+	}
+
+	switch s := stmts[len(stmts)-1].(type) {
+	case *parser.ReturnStatement:
+		return true
+	case *parser.IfStatement:
+		for _, branch := range s.Branches {
+			if !isTerminating(branch.Body) {
+				return false
+			}
+		}
+		return isTerminating(s.Else)
+	default:
+		return false
+	}
+}
+
+func (g *GoGenerator) generatePrintStatement(stmt *parser.PrintStatement) ast.Stmt {
+	g.imports["fmt"] = true
+	args := make([]ast.Expr, len(stmt.Arguments))
 	for i, arg := range stmt.Arguments {
 		args[i] = g.generateExpression(arg)
 	}
-	
-	if len(args) == 1 {
-		return fmt.Sprintf("fmt.Println(%s)", args[0])
+	return &ast.ExprStmt{X: call(selector("fmt", "Println"), args...)}
+}
+
+func (g *GoGenerator) generateAssignmentStatement(stmt *parser.AssignmentStatement) []ast.Stmt {
+	target := g.variableType(stmt.Name)
+	value := g.generateValue(stmt.Value, target)
+
+	name := g.name(stmt.Name)
+	decl, ok := g.scopes.defines[stmt]
+	if !ok {
+		return []ast.Stmt{assign(ident(name), token.ASSIGN, value)}
+	}
+
+	// := would give the variable the type of its first value, which is
+	// too narrow when later assignments widen it
+	var code ast.Stmt = assign(ident(name), token.DEFINE, value)
+	if g.valueType(stmt.Value, decl.typ).GoType() != decl.typ.GoType() {
+		code = varDecl(name, decl.typ.GoTypeExpr(), value)
 	}
-	
-	// Multiple arguments - use fmt.Println with all args
-	return fmt.Sprintf("fmt.Println(%s)", strings.Join(args, ", "))
+	if decl.unused {
+		return []ast.Stmt{code, assign(ident("_"), token.ASSIGN, ident(name))}
+	}
+	return []ast.Stmt{code}
+}
+
+func (g *GoGenerator) generateIndexAssignmentStatement(stmt *parser.IndexAssignmentStatement) ast.Stmt {
+	value := g.generateValue(stmt.Value, g.typeOf(stmt.Target))
+	return assign(g.generateTarget(stmt.Target), token.ASSIGN, value)
+}
+
+// generateTarget generates an expression that can be assigned to. An
+// element of a map is assigned as m[k] rather than looked up with
+// kloLookup, whose result cannot be assigned to.
+func (g *GoGenerator) generateTarget(expr parser.Expression) ast.Expr {
+	if index, ok := expr.(*parser.IndexExpression); ok {
+		return &ast.IndexExpr{
+			X:     primary(g.generateExpression(index.Object)),
+			Index: g.generateExpression(index.Index),
+		}
+	}
+	return g.generateExpression(expr)
+}
+
+func (g *GoGenerator) generateDeleteStatement(stmt *parser.DeleteStatement) ast.Stmt {
+	// Nodes are not shared, as each one gets its own position
+	object := func() ast.Expr { return g.generateExpression(stmt.Target.Object) }
+	index := func() ast.Expr { return g.generateExpression(stmt.Target.Index) }
+
+	if g.typeOf(stmt.Target.Object).Kind == List {
+		g.imports["slices"] = true
+		deleted := call(selector("slices", "Delete"), object(), index(), binary(index(), token.ADD, intLit(1)))
+		return assign(object(), token.ASSIGN, deleted)
+	}
+
+	return &ast.ExprStmt{X: call(ident("delete"), object(), index())}
 }
 
-func (g *GoGenerator) generateAssignmentStatement(stmt *parser.AssignmentStatement) string {
-	value := g.generateExpression(stmt.Value)
-	return fmt.Sprintf("%s := %s", stmt.Name, value)
+func (g *GoGenerator) generateExpressionStatement(stmt *parser.ExpressionStatement) ast.Stmt {
+	// xs.append(v) grows the slice in place
+	if expr, ok := stmt.Expression.(*parser.CallExpression); ok {
+		if member, ok := expr.Function.(*parser.MemberExpression); ok && member.Name == "append" {
+			elem := g.typeOf(member.Object).elem()
+			args := []ast.Expr{g.generateExpression(member.Object)}
+			for _, arg := range expr.Arguments {
+				args = append(args, g.generateValue(arg, elem))
+			}
+			return assign(g.generateTarget(member.Object), token.ASSIGN, call(ident("append"), args...))
+		}
+	}
+
+	if _, ok := stmt.Expression.(*parser.CallExpression); !ok {
+		// Go rejects expressions whose value is not used
+		g.warnings = append(g.warnings, parser.Warningf(parser.SpanOf(stmt.Expression), parser.CodeUnusedValue,
+			"the value of %s is not used", stmt.Expression))
+		return assign(ident("_"), token.ASSIGN, g.generateExpression(stmt.Expression))
+	}
+
+	return &ast.ExprStmt{X: g.generateExpression(stmt.Expression)}
 }
 
-func (g *GoGenerator) generateIfStatement(stmt *parser.IfStatement) string {
-	var output strings.Builder
-	
-	condition := g.generateExpression(stmt.Condition)
-	output.WriteString(fmt.Sprintf("if %s {\n", condition))
-	
-	g.indent++
-	for _, bodyStmt := range stmt.Body {
-		code := g.generateStatement(bodyStmt)
-		if code != "" {
-			output.WriteString(g.indentString() + code + "\n")
+func (g *GoGenerator) generateIfStatement(stmt *parser.IfStatement) ast.Stmt {
+	// elif branches become a flat Go "else if" chain
+	var first, last *ast.IfStmt
+	for _, branch := range stmt.Branches {
+		ifStmt := &ast.IfStmt{
+			Cond: g.generateCondition(branch.Condition),
+			Body: &ast.BlockStmt{List: g.generateBlock(branch.Body)},
+		}
+		if last == nil {
+			first = ifStmt
+		} else {
+			// "} else if" is placed on the line of the elif
+			g.lineDirective(g.line(branch.Pos().Line), branch.Pos())
+			last.Body.Rbrace = g.pos(branch.Pos())
+			last.Else = ifStmt
 		}
+		last = ifStmt
 	}
-	g.indent--
-	
+
 	if len(stmt.Else) > 0 {
-		output.WriteString(g.indentString() + "} else {\n")
-		g.indent++
-		for _, elseStmt := range stmt.Else {
-			code := g.generateStatement(elseStmt)
-			if code != "" {
-				output.WriteString(g.indentString() + code + "\n")
+		last.Body.Rbrace = g.pos(stmt.ElsePos)
+		last.Else = &ast.BlockStmt{Lbrace: g.pos(stmt.ElsePos), List: g.generateBlock(stmt.Else)}
+	}
+
+	return first
+}
+
+func (g *GoGenerator) generateForStatement(stmt *parser.ForStatement) []ast.Stmt {
+	it := g.types.iterationOf(stmt, g.scope())
+	if it.problem != "" {
+		g.errorf(stmt.Iterable, "for loop over %s: %s", stmt.Iterable, it.problem)
+		return nil
+	}
+
+	// A loop variable is declared by the loop when nothing outside the
+	// loop uses it, and Go rejects those that are never read, so they
+	// become _. Other loop variables are declared before the loop, which
+	// assigns them.
+	defines, declared := g.scopes.loopDefines[stmt]
+	tok := token.DEFINE
+	if !declared {
+		tok = token.ASSIGN
+	}
+	needed := func(name string) bool {
+		decl, ok := defines[name]
+		return !ok || !decl.unused
+	}
+	used := func(name string) string {
+		if needed(name) {
+			return g.name(name)
+		}
+		return "_"
+	}
+
+	index, value := "_", used(stmt.Variable)
+	if it.indexed {
+		index, value = used(stmt.Variable), used(stmt.ValueVariable)
+	}
+	lookupValue := it.kind == iterateItems && needed(stmt.ValueVariable)
+	keyTok := tok
+	if lookupValue {
+		// The key is needed to look up the value, so a key that is the
+		// blank identifier gets a variable of the loop's own
+		value = g.name(stmt.Variable)
+		if value == "_" {
+			value, keyTok = loopKey, token.DEFINE
+		}
+	}
+
+	body := &ast.BlockStmt{}
+	if lookupValue {
+		lookup := &ast.IndexExpr{X: primary(g.generateExpression(it.subject)), Index: ident(value)}
+		body.List = append(body.List, assign(ident(g.name(stmt.ValueVariable)), tok, lookup))
+	}
+
+	var loop ast.Stmt
+	switch it.kind {
+	case iterateRange:
+		counter := value
+		if !declared && value != "_" {
+			// The variable keeps the last value of the range after the
+			// loop, so the loop counts with a variable of its own
+			counter = loopCounter
+			body.List = append(body.List, assign(ident(value), token.ASSIGN, ident(counter)))
+		}
+		header := g.generateRangeLoop(counter, it.subject.(*parser.RangeExpression))
+		header.Body, loop = body, header
+	case iterateList:
+		loop = rangeLoop(index, value, tok, g.generateExpression(it.subject), body)
+	case iterateString:
+		// Ranging over a string yields runes, which klo sees as strings of
+		// one character. The loop declares its own variables, which
+		// assign the klo variables at the top of the body.
+		subject := g.generateExpression(it.subject)
+		var assigns []ast.Stmt
+		key, char := "_", "_"
+		if index != "_" {
+			// enumerate() counts characters, not the bytes that ranging
+			// over a string counts
+			subject = call(&ast.ArrayType{Elt: ident("rune")}, subject)
+			key = index
+			if tok == token.ASSIGN {
+				key = loopCounter
+				assigns = append(assigns, assign(ident(index), token.ASSIGN, ident(loopCounter)))
 			}
 		}
-		g.indent--
+		if value != "_" {
+			char = loopRune
+			assigns = append(assigns, assign(ident(value), tok, call(ident("string"), ident(loopRune))))
+		}
+		body.List = append(assigns, body.List...)
+		loop = rangeLoop(key, char, token.DEFINE, subject, body)
+	case iterateKeys, iterateItems:
+		mapType := g.typeOf(it.subject)
+		loop = rangeLoop(index, value, keyTok, g.generateSortedKeys(it.subject, mapType), body)
 	}
-	
-	output.WriteString(g.indentString() + "}")
-	
-	return output.String()
+	g.types.inLoop(stmt, g.scope(), func() {
+		body.List = append(body.List, g.generateBlock(stmt.Body)...)
+	})
+
+	return []ast.Stmt{loop}
 }
 
-func (g *GoGenerator) generateForStatement(stmt *parser.ForStatement) string {
-	var output strings.Builder
-	
-	// Check if iterable is range expression
-	if rangeExpr, ok := stmt.Iterable.(*parser.RangeExpression); ok {
-		end := g.generateExpression(rangeExpr.End)
-		output.WriteString(fmt.Sprintf("for %s := 0; %s < %s; %s++ {\n", 
-			stmt.Variable, stmt.Variable, end, stmt.Variable))
-	} else {
-		// For other iterables (future feature)
-		output.WriteString(fmt.Sprintf("// TODO: Implement iteration over %T\n", stmt.Iterable))
-		return output.String()
-	}
-	
-	g.indent++
-	for _, bodyStmt := range stmt.Body {
-		code := g.generateStatement(bodyStmt)
-		if code != "" {
-			output.WriteString(g.indentString() + code + "\n")
-		}
-	}
-	g.indent--
-	
-	output.WriteString(g.indentString() + "}")
-	
-	return output.String()
+// Variables of range() loops: the counter of a loop whose klo variable is
+// declared before it, and the stop and step when they are not constants.
+// loopKey is the key of an items() loop whose key variable is _, and
+// loopRune the rune of a loop over a string.
+const (
+	loopCounter = "kloIndex"
+	loopStop    = "kloStop"
+	loopStep    = "kloStep"
+	loopKey     = "kloKey"
+	loopRune    = "kloRune"
+)
+
+// rangeLoop returns a Go range loop over the given index and value
+// variables, leaving out those that are _. The variables are declared by
+// the loop or assigned, as tok says.
+func rangeLoop(index, value string, tok token.Token, subject ast.Expr, body *ast.BlockStmt) *ast.RangeStmt {
+	loop := &ast.RangeStmt{X: subject, Body: body}
+	switch {
+	case value != "_":
+		loop.Key, loop.Value, loop.Tok = ident(index), ident(value), tok
+	case index != "_":
+		loop.Key, loop.Tok = ident(index), tok
+	}
+	return loop
 }
 
-func (g *GoGenerator) generateExpression(expr parser.Expression) string {
+// operators maps the klo arithmetic and comparison operators to Go
+var operators = map[string]token.Token{
+	"+":  token.ADD,
+	"-":  token.SUB,
+	"*":  token.MUL,
+	"/":  token.QUO,
+	"%":  token.REM,
+	"==": token.EQL,
+	"!=": token.NEQ,
+	"<":  token.LSS,
+	"<=": token.LEQ,
+	">":  token.GTR,
+	">=": token.GEQ,
+}
+
+func (g *GoGenerator) generateExpression(expr parser.Expression) ast.Expr {
 	switch e := expr.(type) {
 	case *parser.Identifier:
-		return e.Value
+		return ident(g.name(e.Value))
 	case *parser.StringLiteral:
-		return fmt.Sprintf("\"%s\"", e.Value)
+		return stringLit(e.Value)
+	case *parser.InterpolatedString:
+		return g.generateFormat(e.Parts)
 	case *parser.NumberLiteral:
-		return e.Value
+		if e.IsFloat {
+			return &ast.BasicLit{Kind: token.FLOAT, Value: e.Value}
+		}
+		return &ast.BasicLit{Kind: token.INT, Value: e.Value}
 	case *parser.BinaryExpression:
 		return g.generateBinaryExpression(e)
 	case *parser.RangeExpression:
-		// Range expressions are handled in for loops
-		return g.generateExpression(e.End)
+		// Outside of a for loop a range is a real list of ints
+		start, stop, step := g.rangeBounds(e)
+		return call(ident(g.useHelper("kloRange")), start, stop, step)
+	case *parser.BooleanLiteral:
+		return ident(strconv.FormatBool(e.Value))
+	case *parser.NoneLiteral:
+		return ident("nil")
+	case *parser.UnaryExpression:
+		if e.Operator == "not" {
+			return not(g.generateCondition(e.Operand))
+		}
+		return unary(operators[e.Operator], g.generateExpression(e.Operand))
+	case *parser.CallExpression:
+		return g.generateCallExpression(e)
+	case *parser.ListLiteral:
+		return g.generateListLiteral(e, g.typeOf(e))
+	case *parser.DictLiteral:
+		return g.generateDictLiteral(e, g.typeOf(e))
+	case *parser.IndexExpression:
+		return g.generateIndexExpression(e)
+	case *parser.MemberExpression:
+		return &ast.SelectorExpr{X: primary(g.generateExpression(e.Object)), Sel: ident(e.Name)}
 	default:
-		return fmt.Sprintf("/* Unknown expression: %T */", expr)
+		g.errorf(expr, "unsupported expression %s", expr)
+		return ident("nil")
 	}
 }
 
-func (g *GoGenerator) generateBinaryExpression(expr *parser.BinaryExpression) string {
-	left := g.generateExpression(expr.Left)
-	right := g.generateExpression(expr.Right)
-	
-	// Handle string concatenation
-	if expr.Operator == "+" {
-		// If either operand is a string literal, treat as string concatenation
-		if g.isStringExpression(expr.Left) || g.isStringExpression(expr.Right) {
-			return fmt.Sprintf("fmt.Sprintf(\"%%v%%v\", %s, %s)", left, right)
-		}
+// generateValue generates an expression that is stored in a location of
+// type target, so that list literals get the element type of their
+// destination rather than only that of their own elements
+func (g *GoGenerator) generateValue(expr parser.Expression, target *Type) ast.Expr {
+	if list, ok := expr.(*parser.ListLiteral); ok && target != nil && target.Kind == List {
+		return g.generateListLiteral(list, target)
+	}
+	if dict, ok := expr.(*parser.DictLiteral); ok && target != nil && target.Kind == Map {
+		return g.generateDictLiteral(dict, target)
+	}
+	if _, ok := expr.(*parser.NoneLiteral); ok {
+		// An untyped nil cannot initialize a variable
+		return call(ident("any"), ident("nil"))
+	}
+	if g.convertsToFloat(expr, target) {
+		return call(ident("float64"), g.generateExpression(expr))
+	}
+	return g.generateExpression(expr)
+}
+
+// convertsToFloat reports whether an int expression stored in a location
+// of type target needs an explicit conversion. Numeric constants are
+// converted by Go itself.
+func (g *GoGenerator) convertsToFloat(expr parser.Expression, target *Type) bool {
+	if target == nil || target.Kind != Float || g.typeOf(expr).Kind != Int {
+		return false
 	}
-	
-	return fmt.Sprintf("(%s %s %s)", left, expr.Operator, right)
+	_, constant := constantSign(expr)
+	return !constant
 }
 
-func (g *GoGenerator) isStringExpression(expr parser.Expression) bool {
+// valueType returns the Go type of the code generateValue produces
+func (g *GoGenerator) valueType(expr parser.Expression, target *Type) *Type {
+	if g.convertsToFloat(expr, target) {
+		return floatType
+	}
+	t := g.typeOf(expr)
 	switch expr.(type) {
-	case *parser.StringLiteral:
-		return true
+	case *parser.ListLiteral, *parser.DictLiteral:
+		if t.Kind == target.Kind {
+			return target
+		}
+	}
+	return t
+}
+
+func (g *GoGenerator) generateDictLiteral(dict *parser.DictLiteral, mapType *Type) ast.Expr {
+	literal := &ast.CompositeLit{Type: mapType.GoTypeExpr()}
+	for _, entry := range dict.Entries {
+		literal.Elts = append(literal.Elts, &ast.KeyValueExpr{
+			Key:   g.generateValue(entry.Key, mapType.key()),
+			Value: g.generateValue(entry.Value, mapType.elem()),
+		})
+	}
+	return literal
+}
+
+// generateSortedKeys returns the keys of a map in a deterministic order
+func (g *GoGenerator) generateSortedKeys(expr parser.Expression, mapType *Type) ast.Expr {
+	helper := "kloSortedKeysByString"
+	if mapType.key().isOrdered() {
+		helper = "kloSortedKeys"
+	}
+	return call(ident(g.useHelper(helper)), g.generateExpression(expr))
+}
+
+func (g *GoGenerator) generateListLiteral(list *parser.ListLiteral, listType *Type) ast.Expr {
+	literal := &ast.CompositeLit{Type: listType.GoTypeExpr()}
+	for _, element := range list.Elements {
+		literal.Elts = append(literal.Elts, g.generateValue(element, listType.elem()))
+	}
+	return literal
+}
+
+func (g *GoGenerator) generateIndexExpression(expr *parser.IndexExpression) ast.Expr {
+	object := g.generateExpression(expr.Object)
+	objectType := g.typeOf(expr.Object)
+	index := g.generateValue(expr.Index, objectType.key())
+
+	switch objectType.Kind {
+	case String:
+		// Indexing a string yields a one-character string, not a byte
+		runes := call(&ast.ArrayType{Elt: ident("rune")}, object)
+		return call(ident("string"), &ast.IndexExpr{X: runes, Index: index})
+	case Map:
+		return call(ident(g.useHelper("kloLookup")), object, index)
+	}
+
+	return &ast.IndexExpr{X: primary(object), Index: index}
+}
+
+func (g *GoGenerator) generateCallExpression(expr *parser.CallExpression) ast.Expr {
+	var params []*Type
+	if name, ok := expr.Function.(*parser.Identifier); ok {
+		if fn, ok := g.types.functions[name.Value]; ok {
+			params = fn.params
+		} else if name.Value == "len" && len(expr.Arguments) == 1 {
+			return g.generateLen(expr.Arguments[0])
+		}
+	}
+
+	args := make([]ast.Expr, len(expr.Arguments))
+	for i, arg := range expr.Arguments {
+		var param *Type
+		if i < len(params) {
+			param = params[i]
+		}
+		args[i] = g.generateValue(arg, param)
+	}
+
+	return call(g.generateExpression(expr.Function), args...)
+}
+
+// generateLen counts characters rather than bytes for strings
+func (g *GoGenerator) generateLen(arg parser.Expression) ast.Expr {
+	value := g.generateExpression(arg)
+	if g.typeOf(arg).Kind == String {
+		g.imports["unicode/utf8"] = true
+		return call(selector("utf8", "RuneCountInString"), value)
+	}
+	return call(ident("len"), value)
+}
+
+// generateCondition generates an expression used as a truth value. Like
+// in Python, zero numbers, empty strings, lists and dicts and None are
+// false.
+func (g *GoGenerator) generateCondition(expr parser.Expression) ast.Expr {
+	value := g.generateExpression(expr)
+
+	switch g.typeOf(expr).Kind {
+	case Bool:
+		return value
+	case Int, Float:
+		return binary(value, token.NEQ, intLit(0))
+	case String:
+		return binary(value, token.NEQ, stringLit(""))
+	case List, Map:
+		return binary(call(ident("len"), value), token.GTR, intLit(0))
 	default:
-		return false
+		return call(ident(g.useHelper("kloTruthy")), value)
 	}
 }
 
-func (g *GoGenerator) indentString() string {
-	return strings.Repeat("\t", g.indent)
+func (g *GoGenerator) generateBinaryExpression(expr *parser.BinaryExpression) ast.Expr {
+	switch expr.Operator {
+	case "and":
+		return binary(g.generateCondition(expr.Left), token.LAND, g.generateCondition(expr.Right))
+	case "or":
+		return binary(g.generateCondition(expr.Left), token.LOR, g.generateCondition(expr.Right))
+	case "in":
+		return g.generateMembership(expr)
+	case "not in":
+		return not(g.generateMembership(expr))
+	case "+":
+		if g.typeOf(expr).Kind == String {
+			return g.generateConcatenation(expr)
+		}
+	}
+
+	leftType, rightType := g.typeOf(expr.Left), g.typeOf(expr.Right)
+
+	// Mixed int and float operands are computed as floats
+	var operandType *Type
+	if leftType.isNumeric() && rightType.isNumeric() {
+		operandType = joinTypes(leftType, rightType)
+	}
+	left := g.generateValue(expr.Left, operandType)
+	right := g.generateValue(expr.Right, operandType)
+
+	switch {
+	case expr.Operator == "*" && (leftType.Kind == String || rightType.Kind == String):
+		// Repetition, as in "-" * 10
+		g.imports["strings"] = true
+		if leftType.Kind == String {
+			return call(selector("strings", "Repeat"), left, right)
+		}
+		return call(selector("strings", "Repeat"), right, left)
+	case (expr.Operator == "==" || expr.Operator == "!=") && (isCollection(leftType) || isCollection(rightType)):
+		// Slices and maps cannot be compared with == in Go
+		g.imports["reflect"] = true
+		equal := call(selector("reflect", "DeepEqual"), left, right)
+		if expr.Operator == "!=" {
+			return not(equal)
+		}
+		return equal
+	case expr.Operator == "%" && operandType != nil && operandType.Kind == Float:
+		g.imports["math"] = true
+		return call(selector("math", "Mod"), left, right)
+	}
+
+	return binary(left, operators[expr.Operator], right)
+}
+
+// generateConcatenation generates a chain of string concatenations. When
+// every operand is a string they are joined with +; otherwise the chain
+// becomes one fmt.Sprintf, formatting the other operands the way print
+// does.
+func (g *GoGenerator) generateConcatenation(expr *parser.BinaryExpression) ast.Expr {
+	parts := g.concatenationParts(expr)
+	var result ast.Expr
+	for _, part := range parts {
+		var operand ast.Expr
+		switch {
+		case part.Value == nil:
+			operand = stringLit(part.Text)
+		case g.typeOf(part.Value).Kind == String:
+			operand = g.generateExpression(part.Value)
+		default:
+			return g.generateFormat(parts)
+		}
+		if result == nil {
+			result = operand
+		} else {
+			result = binary(result, token.ADD, operand)
+		}
+	}
+	return result
+}
+
+// concatenationParts flattens a chain of concatenations, such as
+// "Total: " + n + " items", into the pieces of the resulting string
+func (g *GoGenerator) concatenationParts(expr parser.Expression) []parser.InterpolationPart {
+	switch e := expr.(type) {
+	case *parser.BinaryExpression:
+		if e.Operator == "+" && g.typeOf(e).Kind == String {
+			return append(g.concatenationParts(e.Left), g.concatenationParts(e.Right)...)
+		}
+	case *parser.StringLiteral:
+		return []parser.InterpolationPart{{Text: e.Value}}
+	}
+	return []parser.InterpolationPart{{Value: expr}}
+}
+
+// generateFormat generates the string made of the parts of an f-string,
+// with a single fmt.Sprintf whose verbs follow the format spec and type
+// of each value
+func (g *GoGenerator) generateFormat(parts []parser.InterpolationPart) ast.Expr {
+	var text, format strings.Builder
+	var args []ast.Expr
+	for _, part := range parts {
+		if part.Value == nil {
+			text.WriteString(part.Text)
+			format.WriteString(strings.ReplaceAll(part.Text, "%", "%%"))
+			continue
+		}
+
+		// The type checker has rejected invalid specs
+		verb, toFloat, percent, _ := FormatVerb(part.Spec, g.typeOf(part.Value))
+		value := g.generateExpression(part.Value)
+		if toFloat {
+			value = call(ident("float64"), value)
+		}
+		if percent {
+			value = binary(value, token.MUL, intLit(100))
+		}
+		format.WriteString(verb)
+		args = append(args, value)
+	}
+
+	if len(args) == 0 {
+		return stringLit(text.String())
+	}
+	g.imports["fmt"] = true
+	return call(selector("fmt", "Sprintf"), append([]ast.Expr{stringLit(format.String())}, args...)...)
+}
+
+func isCollection(t *Type) bool {
+	return t.Kind == List || t.Kind == Map
+}
+
+// generateMembership generates "x in container" for maps, lists and strings
+func (g *GoGenerator) generateMembership(expr *parser.BinaryExpression) ast.Expr {
+	container := g.generateExpression(expr.Right)
+	containerType := g.typeOf(expr.Right)
+
+	switch containerType.Kind {
+	case Map:
+		element := g.generateValue(expr.Left, containerType.key())
+		return call(ident(g.useHelper("kloHasKey")), container, element)
+	case String:
+		g.imports["strings"] = true
+		return call(selector("strings", "Contains"), container, g.generateExpression(expr.Left))
+	default:
+		g.imports["slices"] = true
+		element := g.generateValue(expr.Left, containerType.elem())
+		return call(selector("slices", "Contains"), container, element)
+	}
 }
@@ -0,0 +1,135 @@
+package transpiler
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+)
+
+// Small constructors for the Go syntax tree built by the generator. Nodes
+// have no positions, except for the first token of each statement and the
+// braces of some blocks, which the generator places on klo lines.
+
+func ident(name string) *ast.Ident {
+	return ast.NewIdent(name)
+}
+
+// selector returns pkg.name, as in fmt.Println
+func selector(pkg, name string) *ast.SelectorExpr {
+	return &ast.SelectorExpr{X: ident(pkg), Sel: ident(name)}
+}
+
+func call(fun ast.Expr, args ...ast.Expr) *ast.CallExpr {
+	return &ast.CallExpr{Fun: primary(fun), Args: args}
+}
+
+func stringLit(s string) *ast.BasicLit {
+	return &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(s)}
+}
+
+func intLit(n int) *ast.BasicLit {
+	return &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(n)}
+}
+
+func assign(lhs ast.Expr, tok token.Token, rhs ast.Expr) *ast.AssignStmt {
+	return &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Tok: tok, Rhs: []ast.Expr{rhs}}
+}
+
+// varDecl returns var name typ, or var name typ = value when value is not
+// nil
+func varDecl(name string, typ ast.Expr, value ast.Expr) *ast.DeclStmt {
+	spec := &ast.ValueSpec{Names: []*ast.Ident{ident(name)}, Type: typ}
+	if value != nil {
+		spec.Values = []ast.Expr{value}
+	}
+	return &ast.DeclStmt{Decl: &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{spec}}}
+}
+
+// binary returns the operation x op y, parenthesizing operands that bind
+// less tightly than op. Operators of equal precedence group to the left,
+// so only a right operand of equal precedence needs parentheses.
+func binary(x ast.Expr, op token.Token, y ast.Expr) *ast.BinaryExpr {
+	if b, ok := x.(*ast.BinaryExpr); ok && b.Op.Precedence() < op.Precedence() {
+		x = paren(x)
+	}
+	if b, ok := y.(*ast.BinaryExpr); ok && b.Op.Precedence() <= op.Precedence() {
+		y = paren(y)
+	}
+	return &ast.BinaryExpr{X: x, Op: op, Y: y}
+}
+
+// unary returns the operation op x
+func unary(op token.Token, x ast.Expr) *ast.UnaryExpr {
+	if _, ok := x.(*ast.BinaryExpr); ok {
+		x = paren(x)
+	}
+	return &ast.UnaryExpr{Op: op, X: x}
+}
+
+// not returns the negation of a condition
+func not(x ast.Expr) *ast.UnaryExpr {
+	return unary(token.NOT, x)
+}
+
+func paren(x ast.Expr) *ast.ParenExpr {
+	return &ast.ParenExpr{X: x}
+}
+
+// primary parenthesizes an operation that is called, indexed or selected
+// from
+func primary(x ast.Expr) ast.Expr {
+	switch x.(type) {
+	case *ast.BinaryExpr, *ast.UnaryExpr:
+		return paren(x)
+	}
+	return x
+}
+
+// at places the first token of a statement at pos, so that go/printer
+// keeps the blank lines of the klo source
+func at(node ast.Node, pos token.Pos) {
+	switch n := node.(type) {
+	case *ast.Ident:
+		n.NamePos = pos
+	case *ast.BasicLit:
+		n.ValuePos = pos
+	case *ast.ParenExpr:
+		n.Lparen = pos
+	case *ast.UnaryExpr:
+		n.OpPos = pos
+	case *ast.BinaryExpr:
+		at(n.X, pos)
+	case *ast.CallExpr:
+		at(n.Fun, pos)
+	case *ast.SelectorExpr:
+		at(n.X, pos)
+	case *ast.IndexExpr:
+		at(n.X, pos)
+	case *ast.CompositeLit:
+		at(n.Type, pos)
+	case *ast.ArrayType:
+		n.Lbrack = pos
+	case *ast.MapType:
+		n.Map = pos
+	case *ast.AssignStmt:
+		at(n.Lhs[0], pos)
+	case *ast.ExprStmt:
+		at(n.X, pos)
+	case *ast.IncDecStmt:
+		at(n.X, pos)
+	case *ast.DeclStmt:
+		n.Decl.(*ast.GenDecl).TokPos = pos
+	case *ast.IfStmt:
+		n.If = pos
+	case *ast.ForStmt:
+		n.For = pos
+	case *ast.RangeStmt:
+		n.For = pos
+	case *ast.ReturnStmt:
+		n.Return = pos
+	case *ast.BranchStmt:
+		n.TokPos = pos
+	case *ast.FuncDecl:
+		n.Type.Func = pos
+	}
+}
@@ -0,0 +1,167 @@
+package transpiler
+
+import (
+	"fmt"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+)
+
+// helperSource holds the Go functions that are emitted into the generated
+// program when a klo construct has no direct Go equivalent. It is parsed
+// once; the generated program gets the declarations of the helpers it
+// uses, without the comments.
+const helperSource = `package main
+
+import (
+	"cmp"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+)
+
+// d[k] on a missing key is an error in klo, not a zero value
+func kloLookup[K comparable, V any](m map[K]V, key K) V {
+	value, ok := m[key]
+	if !ok {
+		panic(fmt.Sprintf("KeyError: %v", key))
+	}
+	return value
+}
+
+func kloRange(start, stop, step int) []int {
+	if step == 0 {
+		panic("range() step must not be zero")
+	}
+	values := []int{}
+	for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+		values = append(values, i)
+	}
+	return values
+}
+
+// Python-style truthiness for values whose type is only known at run time
+func kloTruthy(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	switch v := reflect.ValueOf(value); v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() > 0
+	}
+	return true
+}
+
+func kloHasKey[K comparable, V any](m map[K]V, key K) bool {
+	_, ok := m[key]
+	return ok
+}
+
+// Map iteration order is random in Go; klo iterates keys in sorted order
+// so that output is reproducible
+func kloSortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Keys without a natural order (bool, mixed types) sort by printed form
+func kloSortedKeysByString[K comparable, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	return keys
+}
+`
+
+// helper is a function of helperSource
+type helper struct {
+	decl    *ast.FuncDecl
+	imports []string // packages the helper itself needs
+}
+
+// helperFile and helpers are helperSource parsed. The positions of the
+// declarations are those of helperFile, the first file of its file set.
+var helperFile, helpers = parseHelpers()
+
+func parseHelpers() (*token.File, map[string]helper) {
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, "helpers.go", helperSource, 0)
+	if err != nil {
+		panic(fmt.Sprintf("parsing the helper functions: %v", err))
+	}
+
+	// The packages imported are named after their paths
+	packages := map[string]bool{}
+	for _, spec := range file.Imports {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		packages[path] = true
+	}
+
+	parsed := map[string]helper{}
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		used := map[string]bool{}
+		ast.Inspect(fn, func(node ast.Node) bool {
+			if sel, ok := node.(*ast.SelectorExpr); ok {
+				if pkg, ok := sel.X.(*ast.Ident); ok && packages[pkg.Name] {
+					used[pkg.Name] = true
+				}
+			}
+			return true
+		})
+		h := helper{decl: fn}
+		for path := range used {
+			h.imports = append(h.imports, path)
+		}
+		parsed[fn.Name.Name] = h
+	}
+	return fset.File(file.Pos()), parsed
+}
+
+// useHelper marks a helper function, and the packages it needs, as used
+func (g *GoGenerator) useHelper(name string) string {
+	g.helpers[name] = true
+	for _, path := range helpers[name].imports {
+		g.imports[path] = true
+	}
+	return name
+}
+
+// generateHelpers returns the declarations of the helpers used by the
+// program, in order of name
+func (g *GoGenerator) generateHelpers() []ast.Decl {
+	names := make([]string, 0, len(g.helpers))
+	for name := range g.helpers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	decls := make([]ast.Decl, len(names))
+	for i, name := range names {
+		decls[i] = helpers[name].decl
+	}
+	return decls
+}
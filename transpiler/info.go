@@ -0,0 +1,77 @@
+package transpiler
+
+import (
+	"github.com/singleservingfriend/klo/parser"
+)
+
+// Info is what type checking learns about a program: the types of its
+// expressions, variables and functions. Backends other than the Go
+// generator, such as the interpreter, use it to give values the types
+// the generated Go code would give them.
+type Info struct {
+	types    *typeInfo
+	scopes   *scopeInfo
+	Warnings []parser.Diagnostic // problems that do not stop the program
+}
+
+// Check type checks a program without generating Go code. It fails with
+// parser.Diagnostics on the type errors Transpile reports.
+func Check(program *parser.Program) (*Info, error) {
+	return CheckWithGlobals(program, nil)
+}
+
+// CheckWithGlobals is Check for a program that uses variables it need not
+// assign itself, such as those set by an application embedding klo.
+// globals gives their types; assignments in the program may widen them.
+// A global of kind Function is a function of the application, which the
+// program can call with any arguments.
+func CheckWithGlobals(program *parser.Program, globals map[string]*Type) (*Info, error) {
+	types, typeErrors := checkTypes(program, globals)
+	if len(typeErrors) > 0 {
+		return nil, typeErrors
+	}
+
+	scopes := analyzeScopes(program, types)
+	return &Info{types: types, scopes: scopes, Warnings: scopes.warnings}, nil
+}
+
+// TypeOf returns the type of an expression of the program
+func (info *Info) TypeOf(expr parser.Expression) *Type {
+	if t, ok := info.types.exprs[expr]; ok {
+		return t
+	}
+	return unknownType
+}
+
+// VariableType returns the type of a variable of a function, or of the
+// main program when function is "". A function's variables are its
+// parameters and the variables it assigns; the second result is false for
+// any other name.
+func (info *Info) VariableType(function, name string) (*Type, bool) {
+	scope := info.types.globals
+	if fn, ok := info.types.functions[function]; ok {
+		scope = fn.locals
+	}
+	t, ok := scope[name]
+	if ok && t == nil {
+		t = unknownType
+	}
+	return t, ok
+}
+
+// Function returns the parameter types of a def and the type of its
+// result, which is nil when the function never returns a value. The last
+// result is false when the program defines no such function.
+func (info *Info) Function(name string) (params []*Type, result *Type, ok bool) {
+	fn, ok := info.types.functions[name]
+	if !ok {
+		return nil, nil, false
+	}
+	return fn.params, fn.result, true
+}
+
+// Join returns the type that can hold values of both a and b, as the type
+// of a variable assigned both
+func Join(a, b *Type) *Type {
+	return joinTypes(a, b)
+}
@@ -0,0 +1,142 @@
+package transpiler
+
+import (
+	"go/token"
+	"go/types"
+	"sort"
+
+	"github.com/singleservingfriend/klo/parser"
+)
+
+// goPackages are the names of the packages the generated code may import
+var goPackages = map[string]bool{
+	"cmp":     true,
+	"fmt":     true,
+	"math":    true,
+	"reflect": true,
+	"slices":  true,
+	"sort":    true,
+	"strings": true,
+	"utf8":    true,
+}
+
+// isReserved reports whether a klo name cannot be used as is in Go: a Go
+// keyword, a predeclared identifier such as len or string, a package,
+// helper function or variable of the generated code, or a function Go
+// treats specially
+func isReserved(name string) bool {
+	switch name {
+	case loopCounter, loopStop, loopStep, loopKey, loopRune, "main", "init":
+		return true
+	}
+	_, helper := helpers[name]
+	return token.IsKeyword(name) || types.Universe.Lookup(name) != nil || goPackages[name] || helper
+}
+
+// renaming is a klo name that has a different name in Go
+type renaming struct {
+	klo, goName string
+}
+
+// blankName is the Go name of a klo variable named _ that is read, which
+// Go's blank identifier cannot be
+const blankName = "_v"
+
+// mangleNames chooses Go names for the variables, parameters and
+// functions of a program. A reserved name gets underscores appended until
+// it differs from every other name of the program, so that a name is
+// renamed the same way wherever it appears. A variable named _ keeps its
+// name when nothing reads it, and is renamed to blankName otherwise.
+func mangleNames(program *parser.Program) map[string]string {
+	defined := map[string]bool{}
+	var collect func(stmts []parser.Statement)
+	collect = func(stmts []parser.Statement) {
+		for _, stmt := range stmts {
+			switch s := stmt.(type) {
+			case *parser.AssignmentStatement:
+				defined[s.Name] = true
+			case *parser.FunctionDefinition:
+				defined[s.Name] = true
+				for _, param := range s.Parameters {
+					defined[param] = true
+				}
+				collect(s.Body)
+			case *parser.ForStatement:
+				defined[s.Variable] = true
+				if s.ValueVariable != "" {
+					defined[s.ValueVariable] = true
+				}
+				collect(s.Body)
+			case *parser.WhileStatement:
+				collect(s.Body)
+			case *parser.IfStatement:
+				for _, branch := range s.Branches {
+					collect(branch.Body)
+				}
+				collect(s.Else)
+			}
+		}
+	}
+	collect(program.Statements)
+
+	var reserved []string
+	for name := range defined {
+		if name != "_" && isReserved(name) {
+			reserved = append(reserved, name)
+		}
+	}
+	sort.Strings(reserved)
+
+	names := map[string]string{}
+	for _, name := range reserved {
+		goName := name + "_"
+		for defined[goName] || isReserved(goName) {
+			goName += "_"
+		}
+		defined[goName] = true
+		names[name] = goName
+	}
+
+	if defined["_"] && readsBlank(program) {
+		goName := blankName
+		for defined[goName] || isReserved(goName) {
+			goName += "_"
+		}
+		names["_"] = goName
+	}
+	return names
+}
+
+// readsBlank reports whether the main program or a function reads a
+// variable named _
+func readsBlank(program *parser.Program) bool {
+	walker := newScopeWalker(nil)
+	walker.walkBlock(program.Statements)
+	for _, stmt := range program.Statements {
+		if def, ok := stmt.(*parser.FunctionDefinition); ok {
+			walker.walkBlock(def.Body)
+		}
+	}
+	return isRead(walker.occurrences["_"])
+}
+
+// renamings lists the names of the program that are renamed in Go, in
+// alphabetical order
+func (g *GoGenerator) renamings() []renaming {
+	var list []renaming
+	for klo, goName := range g.names {
+		list = append(list, renaming{klo, goName})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].klo < list[j].klo
+	})
+	return list
+}
+
+// name returns the Go name of a klo variable, parameter or function
+func (g *GoGenerator) name(klo string) string {
+	if goName, ok := g.names[klo]; ok {
+		return goName
+	}
+	return klo
+}
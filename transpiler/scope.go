@@ -0,0 +1,449 @@
+package transpiler
+
+import (
+	"sort"
+
+	"github.com/singleservingfriend/klo/parser"
+)
+
+// declaration is a variable declared with var rather than by its first
+// assignment
+type declaration struct {
+	name   string
+	typ    *Type
+	unused bool // never read, so it is discarded with _ = name
+}
+
+// scopeInfo records where each variable of a program is declared in Go.
+// As in Python, a variable belongs to the whole function (or main program)
+// it is assigned in, while Go variables belong to the block they are
+// declared in. A variable whose first assignment comes before every other
+// use, in the same block, is declared by that assignment with :=. Any
+// other variable is declared with var ahead of the statement containing
+// its first use, in the innermost block that encloses all of its uses.
+// Declarations of variables that are never read are followed by a use
+// that keeps Go from rejecting them. A for loop assigns its variables
+// before each run of its body; only a variable used nowhere but in the
+// loop, and assigned by nothing else, is declared by the Go loop itself.
+type scopeInfo struct {
+	defines     map[*parser.AssignmentStatement]declaration     // assignments that declare their variable
+	hoisted     map[parser.Statement][]declaration              // var declarations preceding a statement
+	globals     []declaration                                   // main program variables used by functions
+	loopDefines map[*parser.ForStatement]map[string]declaration // loop variables declared by the loop
+	warnings    []parser.Diagnostic
+}
+
+// blockStep identifies one block of a statement with several blocks, such
+// as an if branch or the else block
+type blockStep struct {
+	owner parser.Statement
+	block int
+	loop  bool // the block is a loop body
+}
+
+// occurrence is one use of a variable
+type occurrence struct {
+	path   []blockStep      // blocks from the function body to the use
+	stmt   parser.Statement // statement containing the use, in its innermost block
+	assign parser.Statement // assignment or for loop assigning the variable, nil for a read
+}
+
+// block returns the statement of the block at depth containing the
+// occurrence; depth must not exceed the length of its path
+func (o occurrence) block(depth int) parser.Statement {
+	if depth == len(o.path) {
+		return o.stmt
+	}
+	return o.path[depth].owner
+}
+
+// scopeWalker collects the occurrences of every variable of one function
+type scopeWalker struct {
+	info        *scopeInfo
+	occurrences map[string][]occurrence
+	path        []blockStep
+	stmt        parser.Statement
+}
+
+func newScopeWalker(info *scopeInfo) *scopeWalker {
+	return &scopeWalker{
+		info:        info,
+		occurrences: map[string][]occurrence{},
+	}
+}
+
+// analyzeScopes decides how every variable of the program is declared
+func analyzeScopes(program *parser.Program, types *typeInfo) *scopeInfo {
+	info := &scopeInfo{
+		defines:     map[*parser.AssignmentStatement]declaration{},
+		hoisted:     map[parser.Statement][]declaration{},
+		loopDefines: map[*parser.ForStatement]map[string]declaration{},
+	}
+
+	var main []parser.Statement
+	var defs []*parser.FunctionDefinition
+	for _, stmt := range program.Statements {
+		if def, ok := stmt.(*parser.FunctionDefinition); ok {
+			defs = append(defs, def)
+		} else {
+			main = append(main, stmt)
+		}
+	}
+
+	mainWalker := newScopeWalker(info)
+	mainWalker.walkBlock(main)
+
+	// A variable named _ that nothing reads stays Go's blank identifier,
+	// which is assigned without being declared
+	blank := !readsBlank(program)
+
+	// Main program variables read by a function that does not assign them
+	// itself are shared, so they become package-level variables
+	var variables []*variable
+	shared := map[string]bool{}
+	for _, def := range defs {
+		walker := newScopeWalker(info)
+		walker.walkBlock(def.Body)
+
+		params := map[string]bool{}
+		for _, param := range def.Parameters {
+			params[param] = true
+		}
+
+		for name, uses := range walker.occurrences {
+			switch {
+			case params[name]:
+			case name == "_" && blank:
+			case isAssigned(uses):
+				variables = append(variables, &variable{
+					name: name, uses: uses, typ: types.functions[def.Name].locals[name], kind: "local variable",
+				})
+			case isAssigned(mainWalker.occurrences[name]):
+				shared[name] = true
+			}
+		}
+	}
+
+	for name, uses := range mainWalker.occurrences {
+		if !isAssigned(uses) || name == "_" && blank {
+			continue
+		}
+		if shared[name] {
+			info.globals = append(info.globals, declaration{name: name, typ: variableType(types.globals[name])})
+			continue
+		}
+		variables = append(variables, &variable{name: name, uses: uses, typ: types.globals[name], kind: "variable"})
+	}
+
+	findOwningLoops(variables)
+	for _, v := range variables {
+		info.declare(v)
+	}
+
+	// Variables are found in map order, and declared in order of name
+	for _, decls := range info.hoisted {
+		sort.Slice(decls, func(i, j int) bool {
+			return decls[i].name < decls[j].name
+		})
+	}
+	sort.Slice(info.globals, func(i, j int) bool {
+		return info.globals[i].name < info.globals[j].name
+	})
+	sort.SliceStable(info.warnings, func(i, j int) bool {
+		return info.warnings[i].Span.From.Offset < info.warnings[j].Span.From.Offset
+	})
+
+	return info
+}
+
+// loopDeclaredVariables returns the variables that each for loop of a
+// program declares itself. Which loops declare which variables does not
+// depend on types, so it is decided by analyzeScopes before types are
+// inferred, with every variable typed unknown.
+func loopDeclaredVariables(program *parser.Program) map[*parser.ForStatement][]string {
+	untyped := &typeInfo{functions: map[string]*functionInfo{}, globals: map[string]*Type{}}
+	for _, stmt := range program.Statements {
+		if def, ok := stmt.(*parser.FunctionDefinition); ok {
+			untyped.functions[def.Name] = &functionInfo{def: def, locals: map[string]*Type{}}
+		}
+	}
+
+	loops := map[*parser.ForStatement][]string{}
+	for loop, decls := range analyzeScopes(program, untyped).loopDefines {
+		for name := range decls {
+			loops[loop] = append(loops[loop], name)
+		}
+	}
+	return loops
+}
+
+// variable is a variable of the main program or of a function, which
+// is declared in Go
+type variable struct {
+	name  string
+	uses  []occurrence
+	typ   *Type
+	kind  string                        // what the variable is called in warnings
+	loops map[*parser.ForStatement]bool // loops declaring the variable themselves, see owningLoops
+}
+
+// declare places the declaration of a variable
+func (info *scopeInfo) declare(v *variable) {
+	name, uses, t, kind := v.name, v.uses, v.typ, v.kind
+	// The innermost block enclosing every use
+	depth := len(uses[0].path)
+	for _, use := range uses[1:] {
+		depth = min(depth, len(use.path))
+		for i := 0; i < depth; i++ {
+			if use.path[i] != uses[0].path[i] {
+				depth = i
+				break
+			}
+		}
+	}
+
+	first := uses[0]
+	decl := declaration{name: name, typ: variableType(t), unused: !isRead(uses)}
+	if decl.unused {
+		// A loop variable that is not needed is the usual way to repeat
+		// a loop body
+		for _, use := range uses {
+			if assign, ok := use.assign.(*parser.AssignmentStatement); ok {
+				info.warnings = append(info.warnings, parser.Warningf(parser.SpanOf(assign), parser.CodeUnusedVariable,
+					"%s '%s' is assigned but never used", kind, name))
+				break
+			}
+		}
+	}
+
+	if assign, ok := first.assign.(*parser.AssignmentStatement); ok && len(first.path) == depth {
+		info.defines[assign] = decl
+		return
+	}
+	if v.loops != nil {
+		for loop, read := range v.loops {
+			if info.loopDefines[loop] == nil {
+				info.loopDefines[loop] = map[string]declaration{}
+			}
+			info.loopDefines[loop][name] = declaration{name: name, typ: decl.typ, unused: !read}
+		}
+		return
+	}
+
+	// A variable declared inside a loop body would be reset on every
+	// iteration, so the declaration moves out of all loops
+	for i := 0; i < depth; i++ {
+		if first.path[i].loop {
+			depth = i
+			break
+		}
+	}
+
+	stmt := first.block(depth)
+	info.hoisted[stmt] = append(info.hoisted[stmt], decl)
+}
+
+// owningLoops returns the for loops that can declare a variable
+// themselves, each with whether its body reads the variable: the variable
+// is assigned by nothing but loops, none of them inside another, and read
+// only inside them. Otherwise it returns nil.
+func owningLoops(uses []occurrence) map[*parser.ForStatement]bool {
+	loops := map[*parser.ForStatement]bool{}
+	for _, use := range uses {
+		loop, ok := use.assign.(*parser.ForStatement)
+		if use.assign != nil && !ok {
+			return nil
+		}
+		if ok {
+			loops[loop] = false
+		}
+	}
+	if len(loops) == 0 {
+		return nil
+	}
+
+	for _, use := range uses {
+		var inside *parser.ForStatement
+		for _, step := range use.path {
+			if loop, ok := step.owner.(*parser.ForStatement); ok {
+				if _, binds := loops[loop]; binds {
+					inside = loop
+				}
+			}
+		}
+		switch {
+		case inside == nil && use.assign == nil:
+			return nil
+		case inside != nil && use.assign != nil:
+			return nil
+		case inside != nil:
+			loops[inside] = true
+		}
+	}
+	return loops
+}
+
+// findOwningLoops finds the loops that declare each variable themselves.
+// A Go range clause either declares all of its variables or assigns all
+// of them, so a loop with two variables declares neither when it cannot
+// declare both; the variable it could declare is then declared once, like
+// any other variable, rather than by each of its loops.
+func findOwningLoops(variables []*variable) {
+	for _, v := range variables {
+		v.loops = owningLoops(v.uses)
+	}
+
+	for changed := true; changed; {
+		changed = false
+		owned := map[*parser.ForStatement]map[string]bool{}
+		for _, v := range variables {
+			for loop := range v.loops {
+				if owned[loop] == nil {
+					owned[loop] = map[string]bool{}
+				}
+				owned[loop][v.name] = true
+			}
+		}
+		for _, v := range variables {
+			for loop := range v.loops {
+				if loop.ValueVariable != "" && (!owned[loop][loop.Variable] || !owned[loop][loop.ValueVariable]) {
+					v.loops = nil
+					changed = true
+					break
+				}
+			}
+		}
+	}
+}
+
+// variableType returns the Go type to declare a variable with
+func variableType(t *Type) *Type {
+	if t == nil || t.Kind == Unknown {
+		return anyType
+	}
+	return t
+}
+
+func isRead(uses []occurrence) bool {
+	for _, use := range uses {
+		if use.assign == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func isAssigned(uses []occurrence) bool {
+	for _, use := range uses {
+		if use.assign != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *scopeWalker) use(name string, assign parser.Statement) {
+	w.occurrences[name] = append(w.occurrences[name], occurrence{
+		path:   append([]blockStep(nil), w.path...),
+		stmt:   w.stmt,
+		assign: assign,
+	})
+}
+
+func (w *scopeWalker) walkBlock(stmts []parser.Statement) {
+	for _, stmt := range stmts {
+		w.stmt = stmt
+		w.walkStatement(stmt)
+	}
+}
+
+// walkNested walks a block belonging to the statement being walked
+func (w *scopeWalker) walkNested(stmts []parser.Statement, block int, loop bool) {
+	owner := w.stmt
+	w.path = append(w.path, blockStep{owner: owner, block: block, loop: loop})
+	w.walkBlock(stmts)
+	w.path = w.path[:len(w.path)-1]
+	w.stmt = owner
+}
+
+func (w *scopeWalker) walkStatement(stmt parser.Statement) {
+	switch s := stmt.(type) {
+	case *parser.AssignmentStatement:
+		w.walkExpression(s.Value)
+		w.use(s.Name, s)
+	case *parser.IndexAssignmentStatement:
+		w.walkExpression(s.Target)
+		w.walkExpression(s.Value)
+	case *parser.DeleteStatement:
+		w.walkExpression(s.Target)
+	case *parser.PrintStatement:
+		for _, arg := range s.Arguments {
+			w.walkExpression(arg)
+		}
+	case *parser.ExpressionStatement:
+		w.walkExpression(s.Expression)
+	case *parser.ReturnStatement:
+		if s.Value != nil {
+			w.walkExpression(s.Value)
+		}
+	case *parser.IfStatement:
+		for i, branch := range s.Branches {
+			w.walkExpression(branch.Condition)
+			w.walkNested(branch.Body, i, false)
+		}
+		w.walkNested(s.Else, len(s.Branches), false)
+	case *parser.WhileStatement:
+		w.walkExpression(s.Condition)
+		w.walkNested(s.Body, 0, true)
+	case *parser.ForStatement:
+		w.walkExpression(s.Iterable)
+		w.use(s.Variable, s)
+		if s.ValueVariable != "" {
+			w.use(s.ValueVariable, s)
+		}
+		w.walkNested(s.Body, 0, true)
+	}
+}
+
+func (w *scopeWalker) walkExpression(expr parser.Expression) {
+	switch e := expr.(type) {
+	case *parser.Identifier:
+		w.use(e.Value, nil)
+	case *parser.BinaryExpression:
+		w.walkExpression(e.Left)
+		w.walkExpression(e.Right)
+	case *parser.UnaryExpression:
+		w.walkExpression(e.Operand)
+	case *parser.CallExpression:
+		w.walkExpression(e.Function)
+		for _, arg := range e.Arguments {
+			w.walkExpression(arg)
+		}
+	case *parser.MemberExpression:
+		w.walkExpression(e.Object)
+	case *parser.IndexExpression:
+		w.walkExpression(e.Object)
+		w.walkExpression(e.Index)
+	case *parser.ListLiteral:
+		for _, elem := range e.Elements {
+			w.walkExpression(elem)
+		}
+	case *parser.DictLiteral:
+		for _, entry := range e.Entries {
+			w.walkExpression(entry.Key)
+			w.walkExpression(entry.Value)
+		}
+	case *parser.RangeExpression:
+		for _, arg := range []parser.Expression{e.Start, e.Stop, e.Step} {
+			if arg != nil {
+				w.walkExpression(arg)
+			}
+		}
+	case *parser.InterpolatedString:
+		for _, part := range e.Parts {
+			if part.Value != nil {
+				w.walkExpression(part.Value)
+			}
+		}
+	}
+}
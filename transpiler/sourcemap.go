@@ -0,0 +1,65 @@
+package transpiler
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SourceMap maps lines of generated Go code back to lines of the klo
+// program, following the //line directives in the code
+type SourceMap struct {
+	lines []int // klo line of each Go line, 0 for support code
+}
+
+// newSourceMap reads the //line directives of generated code. As for the
+// Go compiler, a directive gives the line number of the line after it,
+// and the lines that follow count on from there.
+func newSourceMap(code string) *SourceMap {
+	goLines := strings.Split(code, "\n")
+	m := &SourceMap{lines: make([]int, len(goLines))}
+
+	next := 0
+	for i, line := range goLines {
+		if rest, ok := strings.CutPrefix(line, "//line "); ok {
+			colon := strings.LastIndexByte(rest, ':')
+			n, err := strconv.Atoi(rest[colon+1:])
+			if colon >= 0 && err == nil {
+				next = n
+				continue
+			}
+		}
+		m.lines[i] = next
+		if next > 0 {
+			next++
+		}
+	}
+	return m
+}
+
+// Line returns the klo line that a line of the Go code was generated
+// from, or 0 when it belongs to code klo adds, such as helper functions
+func (m *SourceMap) Line(goLine int) int {
+	if goLine < 1 || goLine > len(m.lines) {
+		return 0
+	}
+	return m.lines[goLine-1]
+}
+
+// Rewrite replaces positions in goFile, as printed by the Go toolchain in
+// error messages and stack traces, with positions in kloFile. Columns are
+// dropped, since they count characters of the Go code. Positions in
+// support code are left as they are.
+func (m *SourceMap) Rewrite(text, goFile, kloFile string) string {
+	pattern := regexp.MustCompile(`(?:[^\s:]*/)?` + regexp.QuoteMeta(filepath.Base(goFile)) + `:(\d+)(?::\d+)?`)
+	return pattern.ReplaceAllStringFunc(text, func(position string) string {
+		match := pattern.FindStringSubmatch(position)
+		goLine, _ := strconv.Atoi(match[1])
+		if line := m.Line(goLine); line > 0 {
+			return fmt.Sprintf("%s:%d", kloFile, line)
+		}
+		return position
+	})
+}
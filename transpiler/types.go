@@ -0,0 +1,630 @@
+package transpiler
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"maps"
+
+	"github.com/singleservingfriend/klo/parser"
+)
+
+// Kind identifies the shape of a klo value in the generated Go code
+type Kind int
+
+const (
+	Unknown Kind = iota // not (yet) inferred
+	Int
+	Float
+	String
+	Bool
+	List
+	Map
+	Function // a def, which can only be called
+	Any      // values of conflicting types
+)
+
+// Type is the inferred Go type of a klo expression or variable
+type Type struct {
+	Kind Kind
+	Key  *Type // key type of a Map
+	Elem *Type // element type of a List, value type of a Map
+}
+
+var (
+	unknownType = &Type{Kind: Unknown}
+	intType     = &Type{Kind: Int}
+	floatType   = &Type{Kind: Float}
+	stringType  = &Type{Kind: String}
+	boolType    = &Type{Kind: Bool}
+	anyType     = &Type{Kind: Any}
+	funcType    = &Type{Kind: Function}
+)
+
+// maxTypeDepth bounds how deeply list and map types may nest, so that a
+// list appended to itself does not grow its type forever
+const maxTypeDepth = 8
+
+// listOf returns the type of a list holding elements of type elem
+func listOf(elem *Type) *Type {
+	if elem.depth() >= maxTypeDepth {
+		elem = anyType
+	}
+	return &Type{Kind: List, Elem: elem}
+}
+
+// mapOf returns the type of a map from key to value
+func mapOf(key, value *Type) *Type {
+	if value.depth() >= maxTypeDepth {
+		value = anyType
+	}
+	return &Type{Kind: Map, Key: key, Elem: value}
+}
+
+// GoType returns the Go spelling of the type
+func (t *Type) GoType() string {
+	switch t.Kind {
+	case Int:
+		return "int"
+	case Float:
+		return "float64"
+	case String:
+		return "string"
+	case Bool:
+		return "bool"
+	case List:
+		return "[]" + t.elem().GoType()
+	case Map:
+		return "map[" + t.key().GoType() + "]" + t.elem().GoType()
+	default:
+		return "any"
+	}
+}
+
+// GoTypeExpr returns the Go type as a syntax tree
+func (t *Type) GoTypeExpr() ast.Expr {
+	switch t.Kind {
+	case List:
+		return &ast.ArrayType{Elt: t.elem().GoTypeExpr()}
+	case Map:
+		return &ast.MapType{Key: t.key().GoTypeExpr(), Value: t.elem().GoTypeExpr()}
+	default:
+		return ast.NewIdent(t.GoType())
+	}
+}
+
+// String returns the klo spelling of the type, as used in messages
+func (t *Type) String() string {
+	switch t.Kind {
+	case Unknown:
+		return "unknown"
+	case Int:
+		return "int"
+	case Float:
+		return "float"
+	case String:
+		return "str"
+	case Bool:
+		return "bool"
+	case List:
+		return "list[" + t.elem().String() + "]"
+	case Map:
+		return "dict[" + t.key().String() + ", " + t.elem().String() + "]"
+	case Function:
+		return "function"
+	default:
+		return "any"
+	}
+}
+
+// ZeroValue returns the Go zero value literal of the type
+func (t *Type) ZeroValue() ast.Expr {
+	switch t.Kind {
+	case Int, Float:
+		return &ast.BasicLit{Kind: token.INT, Value: "0"}
+	case String:
+		return &ast.BasicLit{Kind: token.STRING, Value: `""`}
+	case Bool:
+		return ast.NewIdent("false")
+	default:
+		return ast.NewIdent("nil")
+	}
+}
+
+func (t *Type) elem() *Type {
+	if t.Elem == nil {
+		return unknownType
+	}
+	return t.Elem
+}
+
+func (t *Type) key() *Type {
+	if t.Key == nil {
+		return unknownType
+	}
+	return t.Key
+}
+
+func (t *Type) depth() int {
+	if t.Kind != List && t.Kind != Map {
+		return 0
+	}
+	return 1 + t.elem().depth()
+}
+
+// isOrdered reports whether values of the type can be sorted
+func (t *Type) isOrdered() bool {
+	return t.Kind == Int || t.Kind == Float || t.Kind == String
+}
+
+func (t *Type) isNumeric() bool {
+	return t.Kind == Int || t.Kind == Float
+}
+
+// joinTypes returns the type that can hold values of both a and b
+func joinTypes(a, b *Type) *Type {
+	switch {
+	case a == nil || a.Kind == Unknown:
+		return b
+	case b == nil || b.Kind == Unknown:
+		return a
+	case a.Kind == List && b.Kind == List:
+		return listOf(joinTypes(a.elem(), b.elem()))
+	case a.Kind == Map && b.Kind == Map:
+		return mapOf(joinTypes(a.key(), b.key()), joinTypes(a.elem(), b.elem()))
+	case a.Kind == b.Kind:
+		return a
+	case a.isNumeric() && b.isNumeric():
+		return floatType
+	default:
+		return anyType
+	}
+}
+
+// sameType reports whether a and b describe the same type
+func sameType(a, b *Type) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
+
+// functionInfo holds the signature inferred for a def
+type functionInfo struct {
+	def    *parser.FunctionDefinition
+	params []*Type
+	result *Type            // nil when the function never returns a value
+	locals map[string]*Type // parameters and local variables
+}
+
+// typeInfo is the result of type inference over a whole program
+type typeInfo struct {
+	functions map[string]*functionInfo
+	globals   map[string]*Type                          // variables of the main program
+	loops     map[*parser.ForStatement]map[string]*Type // variables a for loop declares itself
+	exprs     map[parser.Expression]*Type               // type of every expression, once checked
+}
+
+// inferTypes infers the types of variables, lists and functions. Variables
+// are typed flow-insensitively: a variable's type is the join of every
+// value assigned to it, including elements appended to a list. The
+// exception are the variables of a for loop that is the only place they
+// are used, which the loop declares itself: they have a type of their own
+// in each loop, so that loops over a list of ints and a list of strings
+// can use the same variable. Parameter types come from the way a function
+// is called. Because a use may appear before the assignment that
+// determines its type, the analysis is repeated until nothing changes.
+// Variables defined outside the program start with the types given by
+// globals.
+func inferTypes(program *parser.Program, globals map[string]*Type) *typeInfo {
+	info := &typeInfo{
+		functions: map[string]*functionInfo{},
+		globals:   maps.Clone(globals),
+		loops:     map[*parser.ForStatement]map[string]*Type{},
+		exprs:     map[parser.Expression]*Type{},
+	}
+	if info.globals == nil {
+		info.globals = map[string]*Type{}
+	}
+	for loop, names := range loopDeclaredVariables(program) {
+		info.loops[loop] = map[string]*Type{}
+		for _, name := range names {
+			info.loops[loop][name] = unknownType
+		}
+	}
+
+	for _, stmt := range program.Statements {
+		if def, ok := stmt.(*parser.FunctionDefinition); ok {
+			// The checker reports a function defined again
+			if _, defined := info.functions[def.Name]; defined {
+				continue
+			}
+			params := make([]*Type, len(def.Parameters))
+			for i := range params {
+				params[i] = unknownType
+			}
+			info.functions[def.Name] = &functionInfo{
+				def:    def,
+				params: params,
+				locals: map[string]*Type{},
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		inf := &inferencer{info: info}
+
+		for _, stmt := range program.Statements {
+			if _, ok := stmt.(*parser.FunctionDefinition); !ok {
+				inf.inferStatement(stmt, info.globals, nil)
+			}
+		}
+
+		for _, fn := range info.functions {
+			for i, param := range fn.def.Parameters {
+				inf.bind(fn.locals, param, fn.params[i])
+			}
+			inf.inferBlock(fn.def.Body, fn.locals, fn)
+		}
+
+		changed = inf.changed
+	}
+
+	return info
+}
+
+// typeOf returns the inferred type of an expression in the given scope
+func (info *typeInfo) typeOf(expr parser.Expression, scope map[string]*Type) *Type {
+	inf := &inferencer{info: info}
+	return inf.typeOf(expr, scope)
+}
+
+// inLoop runs f with the variables a for loop declares itself bound to
+// their types in scope, and records how f widens them
+func (info *typeInfo) inLoop(loop *parser.ForStatement, scope map[string]*Type, f func()) {
+	saved := map[string]*Type{}
+	for name, t := range info.loops[loop] {
+		if outer, ok := scope[name]; ok {
+			saved[name] = outer
+		}
+		scope[name] = t
+	}
+	f()
+	for name := range info.loops[loop] {
+		info.loops[loop][name] = scope[name]
+		if outer, ok := saved[name]; ok {
+			scope[name] = outer
+		} else {
+			delete(scope, name)
+		}
+	}
+}
+
+// iterationOf analyses a for loop in the given scope
+func (info *typeInfo) iterationOf(stmt *parser.ForStatement, scope map[string]*Type) *iteration {
+	inf := &inferencer{info: info}
+	return inf.iterationOf(stmt, scope)
+}
+
+type inferencer struct {
+	info    *typeInfo
+	changed bool
+}
+
+func (inf *inferencer) update(target **Type, t *Type) {
+	joined := joinTypes(*target, t)
+	if joined != nil && !sameType(joined, *target) {
+		*target = joined
+		inf.changed = true
+	}
+}
+
+func (inf *inferencer) bind(scope map[string]*Type, name string, t *Type) {
+	current := scope[name]
+	inf.update(&current, t)
+	scope[name] = current
+}
+
+// refine widens the type of the variable an expression refers to, so
+// that appending to a list or storing into a list or map updates its
+// element type
+func (inf *inferencer) refine(expr parser.Expression, t *Type, scope map[string]*Type) {
+	switch e := expr.(type) {
+	case *parser.Identifier:
+		if _, ok := scope[e.Value]; ok {
+			inf.bind(scope, e.Value, t)
+		} else if _, ok := inf.info.globals[e.Value]; ok {
+			inf.bind(inf.info.globals, e.Value, t)
+		}
+	case *parser.IndexExpression:
+		inf.refineElement(e, t, scope)
+	}
+}
+
+// refineElement records that a value of type t is stored at target
+func (inf *inferencer) refineElement(target *parser.IndexExpression, t *Type, scope map[string]*Type) {
+	switch inf.typeOf(target.Object, scope).Kind {
+	case List:
+		inf.refine(target.Object, listOf(t), scope)
+	case Map:
+		inf.refine(target.Object, mapOf(inf.typeOf(target.Index, scope), t), scope)
+	}
+}
+
+func (inf *inferencer) inferStatement(stmt parser.Statement, scope map[string]*Type, fn *functionInfo) {
+	switch s := stmt.(type) {
+	case *parser.AssignmentStatement:
+		inf.bind(scope, s.Name, inf.typeOf(s.Value, scope))
+	case *parser.IndexAssignmentStatement:
+		inf.typeOf(s.Target, scope)
+		inf.refineElement(s.Target, inf.typeOf(s.Value, scope), scope)
+	case *parser.DeleteStatement:
+		inf.typeOf(s.Target, scope)
+	case *parser.PrintStatement:
+		for _, arg := range s.Arguments {
+			inf.typeOf(arg, scope)
+		}
+	case *parser.ExpressionStatement:
+		inf.typeOf(s.Expression, scope)
+	case *parser.IfStatement:
+		for _, branch := range s.Branches {
+			inf.typeOf(branch.Condition, scope)
+			inf.inferBlock(branch.Body, scope, fn)
+		}
+		inf.inferBlock(s.Else, scope, fn)
+	case *parser.ForStatement:
+		it := inf.iterationOf(s, scope)
+		inf.info.inLoop(s, scope, func() {
+			inf.bind(scope, s.Variable, it.first)
+			if s.ValueVariable != "" {
+				inf.bind(scope, s.ValueVariable, it.second)
+			}
+			inf.inferBlock(s.Body, scope, fn)
+		})
+	case *parser.WhileStatement:
+		inf.typeOf(s.Condition, scope)
+		inf.inferBlock(s.Body, scope, fn)
+	case *parser.ReturnStatement:
+		if fn != nil && s.Value != nil {
+			inf.update(&fn.result, inf.typeOf(s.Value, scope))
+		}
+	}
+}
+
+// iterationKind describes how a for loop walks its iterable
+type iterationKind int
+
+const (
+	iterateInvalid iterationKind = iota
+	iterateRange                 // range(...)
+	iterateList                  // elements of a list
+	iterateString                // characters of a string
+	iterateKeys                  // keys of a map, sorted
+	iterateItems                 // key/value pairs of a map via d.items()
+)
+
+// iteration is the analysed shape of a for loop
+type iteration struct {
+	kind    iterationKind
+	subject parser.Expression // the range, list, string or map walked
+	indexed bool              // enumerate(): the first variable counts
+	first   *Type             // type of the first loop variable
+	second  *Type             // type of the second loop variable, if any
+	problem string            // why the loop is invalid
+}
+
+// iterationOf works out what a for loop iterates over and the types of
+// its loop variables
+func (inf *inferencer) iterationOf(stmt *parser.ForStatement, scope map[string]*Type) *iteration {
+	it := &iteration{subject: stmt.Iterable, first: unknownType, second: unknownType}
+
+	if call, ok := stmt.Iterable.(*parser.CallExpression); ok {
+		switch fn := call.Function.(type) {
+		case *parser.Identifier:
+			if fn.Value == "enumerate" && len(call.Arguments) == 1 && inf.info.functions["enumerate"] == nil {
+				it.indexed = true
+				it.subject = call.Arguments[0]
+			}
+		case *parser.MemberExpression:
+			if fn.Name == "items" && len(call.Arguments) == 0 {
+				subject := inf.typeOf(fn.Object, scope)
+				if subject.Kind != Map {
+					it.problem = fmt.Sprintf("items() needs a dict, got %s", subject)
+					return it
+				}
+				it.kind = iterateItems
+				it.subject = fn.Object
+				it.first, it.second = subject.key(), subject.elem()
+				if stmt.ValueVariable == "" {
+					it.problem = "items() needs two loop variables, as in: for key, value in d.items()"
+				}
+				return it
+			}
+		}
+	}
+
+	subject := inf.typeOf(it.subject, scope)
+	var elem *Type
+	switch {
+	case isRange(it.subject):
+		it.kind, elem = iterateRange, intType
+	case subject.Kind == List:
+		it.kind, elem = iterateList, subject.elem()
+	case subject.Kind == String:
+		it.kind, elem = iterateString, stringType
+	case subject.Kind == Map:
+		it.kind, elem = iterateKeys, subject.key()
+	default:
+		it.kind = iterateInvalid
+		it.problem = fmt.Sprintf("cannot iterate over %s of type %s", it.subject, subject)
+		return it
+	}
+
+	if it.indexed {
+		it.first, it.second = intType, elem
+		if stmt.ValueVariable == "" {
+			it.problem = "enumerate() needs two loop variables, as in: for i, x in enumerate(xs)"
+		} else if it.kind == iterateRange {
+			it.problem = "enumerate() over range() is not supported; loop over the range directly"
+		}
+		return it
+	}
+
+	it.first = elem
+	if stmt.ValueVariable != "" {
+		it.problem = fmt.Sprintf("cannot unpack %s into two loop variables; use enumerate() or items()", it.subject)
+	}
+	return it
+}
+
+func isRange(expr parser.Expression) bool {
+	_, ok := expr.(*parser.RangeExpression)
+	return ok
+}
+
+func (inf *inferencer) inferBlock(stmts []parser.Statement, scope map[string]*Type, fn *functionInfo) {
+	for _, stmt := range stmts {
+		inf.inferStatement(stmt, scope, fn)
+	}
+}
+
+func (inf *inferencer) typeOf(expr parser.Expression, scope map[string]*Type) *Type {
+	switch e := expr.(type) {
+	case *parser.NumberLiteral:
+		if e.IsFloat {
+			return floatType
+		}
+		return intType
+	case *parser.StringLiteral:
+		return stringType
+	case *parser.InterpolatedString:
+		for _, part := range e.Parts {
+			if part.Value != nil {
+				inf.typeOf(part.Value, scope)
+			}
+		}
+		return stringType
+	case *parser.BooleanLiteral:
+		return boolType
+	case *parser.NoneLiteral:
+		return anyType
+	case *parser.UnaryExpression:
+		operand := inf.typeOf(e.Operand, scope)
+		if e.Operator == "not" {
+			return boolType
+		}
+		return operand
+	case *parser.Identifier:
+		if t, ok := scope[e.Value]; ok && t != nil {
+			return t
+		}
+		// Functions can read variables of the main program
+		if t, ok := inf.info.globals[e.Value]; ok && t != nil {
+			return t
+		}
+		if _, ok := inf.info.functions[e.Value]; ok {
+			return funcType
+		}
+		return unknownType
+	case *parser.BinaryExpression:
+		left := inf.typeOf(e.Left, scope)
+		right := inf.typeOf(e.Right, scope)
+		switch e.Operator {
+		case "==", "!=", "<", "<=", ">", ">=", "in", "not in", "and", "or":
+			return boolType
+		case "+":
+			if left.Kind == String || right.Kind == String {
+				return stringType
+			}
+		case "*":
+			// Repetition, as in "-" * 10
+			if left.Kind == String || right.Kind == String {
+				return stringType
+			}
+		}
+		if left.Kind == Unknown || right.Kind == Unknown {
+			return unknownType
+		}
+		return joinTypes(left, right)
+	case *parser.RangeExpression:
+		for _, arg := range []parser.Expression{e.Start, e.Stop, e.Step} {
+			if arg != nil {
+				inf.typeOf(arg, scope)
+			}
+		}
+		return listOf(intType)
+	case *parser.ListLiteral:
+		var elem *Type
+		for _, element := range e.Elements {
+			elem = joinTypes(elem, inf.typeOf(element, scope))
+		}
+		if elem == nil {
+			elem = unknownType
+		}
+		return listOf(elem)
+	case *parser.DictLiteral:
+		var key, value *Type
+		for _, entry := range e.Entries {
+			key = joinTypes(key, inf.typeOf(entry.Key, scope))
+			value = joinTypes(value, inf.typeOf(entry.Value, scope))
+		}
+		if key == nil {
+			key, value = unknownType, unknownType
+		}
+		return mapOf(key, value)
+	case *parser.IndexExpression:
+		object := inf.typeOf(e.Object, scope)
+		inf.typeOf(e.Index, scope)
+		switch object.Kind {
+		case List, Map:
+			return object.elem()
+		case String:
+			return stringType
+		default:
+			return unknownType
+		}
+	case *parser.CallExpression:
+		return inf.typeOfCall(e, scope)
+	default:
+		return unknownType
+	}
+}
+
+func (inf *inferencer) typeOfCall(call *parser.CallExpression, scope map[string]*Type) *Type {
+	argTypes := make([]*Type, len(call.Arguments))
+	for i, arg := range call.Arguments {
+		argTypes[i] = inf.typeOf(arg, scope)
+	}
+
+	// Methods on lists
+	if member, ok := call.Function.(*parser.MemberExpression); ok {
+		if member.Name == "append" && len(argTypes) == 1 {
+			inf.refine(member.Object, listOf(argTypes[0]), scope)
+		}
+		return unknownType
+	}
+
+	name, ok := call.Function.(*parser.Identifier)
+	if !ok {
+		return unknownType
+	}
+
+	fn, ok := inf.info.functions[name.Value]
+	if !ok {
+		if name.Value == "len" {
+			return intType
+		}
+		return unknownType
+	}
+
+	for i := range fn.params {
+		if i < len(argTypes) {
+			inf.update(&fn.params[i], argTypes[i])
+		}
+	}
+
+	if fn.result == nil {
+		return unknownType
+	}
+	return fn.result
+}